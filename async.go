@@ -0,0 +1,159 @@
+package httpgzip
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// asyncWriter hands the writes of the handler to a compression goroutine,
+// so the handler can produce the next chunk of the response while the
+// previous one is compressed. The handler fills one buffer while the other
+// one is compressed and waits when it fills up before the compression is
+// done.
+//
+// The gzip writer is only used by one goroutine at a time: by the
+// compression goroutine while a chunk is being compressed and by the
+// handler otherwise. The compressed output is collected in zout and written
+// out by the handler, so the response is only ever touched by the handler.
+type asyncWriter struct {
+	w  *gzipResponseWriter
+	gw *gzip.Writer
+	// Output of the gzip writer.
+	zout bytes.Buffer
+
+	// Buffer being filled by the handler.
+	cur []byte
+	// Buffer being compressed, if busy, or the free one.
+	spare []byte
+	busy  bool
+
+	jobs chan []byte
+	done chan error
+}
+
+func newAsyncWriter(w *gzipResponseWriter, gw *gzip.Writer) *asyncWriter {
+	a := &asyncWriter{w: w, gw: gw}
+	gw.Reset(&a.zout)
+	return a
+}
+
+func (a *asyncWriter) Write(b []byte) (int, error) {
+	size := a.w.cfg.asyncSize
+	var n int
+	for len(b) > 0 {
+		if a.cur == nil {
+			a.cur = make([]byte, 0, size)
+		}
+		m := min(size-len(a.cur), len(b))
+		a.cur = append(a.cur, b[:m]...)
+		b = b[m:]
+		n += m
+		if len(a.cur) == size {
+			if err := a.submit(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// submit hands the current buffer to the compression goroutine once the
+// previous one is compressed.
+func (a *asyncWriter) submit() error {
+	if err := a.wait(); err != nil {
+		return err
+	}
+	if a.jobs == nil {
+		a.jobs = make(chan []byte)
+		a.done = make(chan error)
+		go a.compress(a.gw, a.jobs, a.done)
+	}
+
+	a.jobs <- a.cur
+	a.busy = true
+	a.cur, a.spare = a.spare[:0], a.cur
+	return nil
+}
+
+func (a *asyncWriter) compress(gw *gzip.Writer, jobs <-chan []byte, done chan<- error) {
+	for b := range jobs {
+		_, err := gw.Write(b)
+		done <- err
+	}
+}
+
+// wait waits for the buffer being compressed, if any, and writes out the
+// compressed output.
+func (a *asyncWriter) wait() error {
+	if a.busy {
+		a.busy = false
+		if err := <-a.done; err != nil {
+			return err
+		}
+	}
+	return a.drain()
+}
+
+// drain writes the output of the gzip writer to the response.
+func (a *asyncWriter) drain() error {
+	if a.zout.Len() == 0 {
+		return nil
+	}
+	out := a.zout.Bytes()
+	n, err := gzipOutput{a.w}.Write(out)
+	if err == nil && n < len(out) {
+		err = io.ErrShortWrite
+	}
+	a.zout.Reset()
+	return err
+}
+
+// sync compresses all the buffered writes.
+func (a *asyncWriter) sync() error {
+	if len(a.cur) > 0 {
+		if err := a.submit(); err != nil {
+			return err
+		}
+	}
+	return a.wait()
+}
+
+// Flush compresses all the buffered writes and flushes the gzip writer.
+func (a *asyncWriter) Flush() error {
+	if err := a.sync(); err != nil {
+		return err
+	}
+	if err := a.gw.Flush(); err != nil {
+		return err
+	}
+	return a.drain()
+}
+
+// Close compresses all the buffered writes, stops the compression goroutine
+// and closes the gzip writer.
+func (a *asyncWriter) Close() error {
+	err := a.sync()
+	a.stop()
+	if err != nil {
+		return err
+	}
+	if err := a.gw.Close(); err != nil {
+		return err
+	}
+	return a.drain()
+}
+
+// stop stops the compression goroutine once it is done with the gzip
+// writer, without writing anything more to the response.
+func (a *asyncWriter) stop() {
+	if a.busy {
+		a.busy = false
+		<-a.done
+	}
+	if a.jobs != nil {
+		close(a.jobs)
+		a.jobs = nil
+	}
+}
@@ -0,0 +1,86 @@
+package httpgzip
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// ErrCompressionStarted is returned by MarkSecret when the response is
+// already being compressed.
+var ErrCompressionStarted = errors.New("httpgzip: compression has already started")
+
+// MarkSecret marks the response as containing secrets, such as CSRF tokens,
+// so it is never compressed, which protects it from the BREACH attack. It
+// must be called before the first write of the response body.
+func MarkSecret(w http.ResponseWriter) error {
+	gw := findResponseWriter(w)
+	if gw == nil {
+		return nil
+	}
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if gw.compress {
+		return ErrCompressionStarted
+	}
+	gw.secret = true
+	return nil
+}
+
+// findResponseWriter returns the gzipResponseWriter wrapped by w, if any.
+func findResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	for {
+		switch t := w.(type) {
+		case interface{ gzipWriter() *gzipResponseWriter }:
+			return t.gzipWriter()
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+func (w *gzipResponseWriter) gzipWriter() *gzipResponseWriter {
+	return w
+}
+
+// isCrossSite reports whether the request was made by another site, based on
+// the Sec-Fetch-Site header or, for older browsers, the Origin and Referer
+// headers.
+func isCrossSite(r *http.Request) bool {
+	if site := r.Header.Get(secFetchSite); site != "" {
+		return site == "cross-site"
+	}
+	if o := r.Header.Get(origin); o != "" {
+		return !sameHost(o, r.Host)
+	}
+	if referer := r.Referer(); referer != "" {
+		return !sameHost(referer, r.Host)
+	}
+	return false
+}
+
+func sameHost(rawURL, host string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Host == host
+}
+
+// padding is the source of the random length padding, which is stored in the
+// extra field of the gzip header.
+var padding [maxPadding]byte
+
+const maxPadding = 0xffff
+
+// paddingLen returns a random length between 0 and max inclusive.
+func paddingLen(max int) int {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return max
+	}
+	return int(binary.LittleEndian.Uint16(b[:])) % (max + 1)
+}
@@ -1,10 +1,17 @@
 package httpgzip
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"hash"
+	"log/slog"
 	"mime"
 	"net/http"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/klauspost/compress/gzip"
 )
@@ -13,8 +20,55 @@ type Config struct {
 	minSize      int
 	level        int
 	contentTypes []parsedContentType
+	rules        []contentTypeRule
 
-	pool sync.Pool
+	streamingTypes    []parsedContentType
+	flushStreamEvents bool
+	flushLatency      time.Duration
+
+	uncompressedTrailers bool
+	digestAlgs           []string
+	bufferSize           int
+
+	skipCrossSite bool
+	padding       int
+
+	adaptiveInFlight  int
+	statelessInFlight int
+	maxInFlight       int
+	semWait           time.Duration
+	levelFunc         LevelFunc
+
+	observer Observer
+	tracer   Tracer
+
+	serverTiming func(r *http.Request) bool
+	debugHeaders func(r *http.Request) bool
+
+	logger  *slog.Logger
+	onError ErrorHandler
+
+	stopOnDisconnect bool
+	disconnectErr    error
+
+	parallelThreshold int
+	blockSize         int
+	workers           int
+	asyncSize         int
+	// If true, then the time spent compressing is measured.
+	measure bool
+
+	// Semaphore of MaxInFlight.
+	sem chan struct{}
+	// Number of responses being compressed.
+	inflight atomic.Int64
+	// Number of responses rejected by MaxInFlight.
+	rejected atomic.Uint64
+	// Pool of gzip writers, see getWriter.
+	encoders *EncoderPool
+	// Pool of response writers, see PoolResponseWriters.
+	poolWriters bool
+	writers     sync.Pool
 }
 
 func New(opts ...Option) (*Config, error) {
@@ -22,6 +76,7 @@ func New(opts ...Option) (*Config, error) {
 		level:   gzip.DefaultCompression,
 		minSize: DefaultMinSize,
 	}
+	StreamingContentTypes(DefaultStreamingContentTypes)(c)
 
 	for _, o := range opts {
 		o(c)
@@ -31,12 +86,19 @@ func New(opts ...Option) (*Config, error) {
 		return nil, err
 	}
 
-	c.pool = sync.Pool{
-		New: func() interface{} {
-			w, _ := gzip.NewWriterLevel(nil, c.level)
-			return w
-		},
+	if c.maxInFlight > 0 {
+		c.sem = make(chan struct{}, c.maxInFlight)
+	}
+	if c.encoders == nil {
+		c.encoders = NewEncoderPool(0)
+	}
+	if c.blockSize == 0 {
+		c.blockSize = defaultBlockSize
+	}
+	if c.workers == 0 {
+		c.workers = runtime.GOMAXPROCS(0)
 	}
+	c.measure = c.observer != nil || c.serverTiming != nil
 
 	return c, nil
 }
@@ -45,39 +107,177 @@ func (c *Config) AcceptsGzip(r *http.Request) bool {
 	return acceptsGzip(r)
 }
 
+// Handler returns a handler that compresses the responses of h.
 func (c *Config) Handler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add(vary, acceptEncoding)
 
 		if !c.AcceptsGzip(r) {
+			c.skipped(w, r, ReasonNoAccept)
+			h.ServeHTTP(w, r)
+			return
+		}
+		if c.skipCrossSite && isCrossSite(r) {
+			c.skipped(w, r, ReasonCrossSite)
 			h.ServeHTTP(w, r)
 			return
 		}
 
-		gw := c.ResponseWriter(w)
-		defer gw.Close()
+		gw := c.newResponseWriter(w, r)
+		defer func() {
+			// The response of a panicking handler is aborted by net/http,
+			// so it must not be finished with a gzip footer or the
+			// buffered body.
+			if p := recover(); p != nil {
+				gw.abort()
+				panic(p)
+			}
+			if err := gw.Close(); err != nil {
+				c.failed(r, "close", err)
+			}
+			c.putResponseWriter(gw)
+		}()
 
-		h.ServeHTTP(gw, r)
+		h.ServeHTTP(gw.wrap(), r)
 	})
 }
 
+// skipped notifies the observer about a request that is served without the
+// compressing writer.
+func (c *Config) skipped(w http.ResponseWriter, r *http.Request, reason SkipReason) {
+	if c.observer != nil {
+		c.observer.Decided(r, Decision{Reason: reason})
+	}
+	c.logDecision(r, Decision{Reason: reason})
+	if enabled(c.debugHeaders, r) {
+		w.Header().Set(compressionSkipReason, reason.String())
+	}
+}
+
 func (c *Config) ResponseWriter(w http.ResponseWriter) ResponseWriter {
-	gw := &gzipResponseWriter{
+	return c.newResponseWriter(w, nil).wrap()
+}
+
+func (c *Config) newResponseWriter(w http.ResponseWriter, r *http.Request) *gzipResponseWriter {
+	var gw *gzipResponseWriter
+	if c.poolWriters {
+		gw, _ = c.writers.Get().(*gzipResponseWriter)
+	}
+	if gw == nil {
+		gw = new(gzipResponseWriter)
+	}
+	*gw = gzipResponseWriter{
 		ResponseWriter: w,
 		cfg:            c,
-	}
-	if _, ok := w.(http.CloseNotifier); ok {
-		return &gzipResponseWriterWithCloseNotify{gw}
+		req:            r,
+		span:           c.startSpan(r),
+		timing:         enabled(c.serverTiming, r),
+		debug:          enabled(c.debugHeaders, r),
+		spare:          gw.spare,
 	}
 	return gw
 }
 
+// putResponseWriter puts the closed writer back into the pool, if enabled,
+// keeping its buffer unless it outgrew maxSpareSize. Writers with a flush
+// timer are left to the garbage collector, since the timer can still refer to
+// them.
+func (c *Config) putResponseWriter(w *gzipResponseWriter) {
+	// The timer or onDisconnect can still be running, so the writer can't
+	// be reused.
+	if !c.poolWriters || w.timer != nil || w.stopDisconnect != nil {
+		return
+	}
+	spare := w.spare[:0]
+	if cap(spare) > maxSpareSize {
+		spare = nil
+	}
+	*w = gzipResponseWriter{spare: spare}
+	c.writers.Put(w)
+}
+
+// streamDelimiter returns the event delimiter for the content type or nil if
+// it is not a streaming content type.
+func (c *Config) streamDelimiter(ct *parsedContentType) []byte {
+	if ct == nil {
+		return nil
+	}
+	for _, s := range c.streamingTypes {
+		if s.equals(ct.mediaType, ct.params) {
+			if s.mediaType == eventStream {
+				return eventDelimiter
+			}
+			return lineDelimiter
+		}
+	}
+	return nil
+}
+
+// rule returns the first ContentTypeRule matching the content type, if any.
+func (c *Config) rule(ct *parsedContentType) *contentTypeRule {
+	if len(c.rules) == 0 || ct == nil {
+		return nil
+	}
+	for i := range c.rules {
+		if c.rules[i].equals(ct.mediaType, ct.params) {
+			return &c.rules[i]
+		}
+	}
+	return nil
+}
+
 func (c *Config) validate() error {
-	if c.level != gzip.DefaultCompression &&
-		(c.level < gzip.BestSpeed || c.level > gzip.BestCompression) {
+	if !validLevel(c.level) {
 		return fmt.Errorf("invalid compression level requested: %d", c.level)
 	}
 
+	for _, rule := range c.rules {
+		if rule.level != 0 && !validLevel(rule.level) {
+			return fmt.Errorf("invalid compression level requested for %s: %d", rule.mediaType, rule.level)
+		}
+	}
+
+	for _, alg := range c.digestAlgs {
+		if _, ok := digestAlgs[alg]; !ok {
+			return fmt.Errorf("unsupported digest algorithm: %q", alg)
+		}
+	}
+
+	if c.adaptiveInFlight < 0 {
+		return fmt.Errorf("adaptive in-flight limit must not be negative")
+	}
+
+	if c.parallelThreshold < 0 || c.blockSize < 0 || c.workers < 0 {
+		return fmt.Errorf("parallel compression threshold, block size and workers must not be negative")
+	}
+
+	if c.asyncSize < 0 {
+		return fmt.Errorf("async compression buffer size must not be negative")
+	}
+	if c.asyncSize > 0 && c.parallelThreshold > 0 {
+		return fmt.Errorf("async and parallel compression can't be used together")
+	}
+
+	if c.statelessInFlight < 0 {
+		return fmt.Errorf("stateless in-flight threshold must not be negative")
+	}
+
+	if c.maxInFlight < 0 || c.semWait < 0 {
+		return fmt.Errorf("in-flight limit and wait must not be negative")
+	}
+
+	if c.padding < 0 || c.padding > maxPadding {
+		return fmt.Errorf("padding must be between 0 and %d", maxPadding)
+	}
+
+	if c.bufferSize < 0 {
+		return fmt.Errorf("buffer size must not be negative")
+	}
+
+	if c.flushLatency < 0 {
+		return fmt.Errorf("flush latency must not be negative")
+	}
+
 	if c.minSize < 0 {
 		return fmt.Errorf("minimum size must be more than zero")
 	}
@@ -87,12 +287,23 @@ func (c *Config) validate() error {
 
 type Option func(c *Config)
 
+// digestAlgs are the supported Content-Digest algorithms.
+var digestAlgs = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
 func MinSize(size int) Option {
 	return func(c *Config) {
 		c.minSize = size
 	}
 }
 
+// CompressionLevel sets the compression level of the responses. Besides
+// gzip.DefaultCompression and gzip.BestSpeed to gzip.BestCompression, it
+// can be one of the low-memory modes: gzip.HuffmanOnly, which only does
+// Huffman coding, and gzip.StatelessCompression, which keeps no state
+// between writes, so a compressed response takes very little memory.
 func CompressionLevel(level int) Option {
 	return func(c *Config) {
 		c.level = level
@@ -115,6 +326,9 @@ func CompressionLevel(level int) Option {
 // that has the same MIME type and other directives. I.e.,
 // "text/html; charset=utf-8" will only match "text/html; charset=utf-8".
 //
+// The subtype or both the type and the subtype can be a wildcard. I.e.,
+// "text/*" will match all text types and "*/*" will match everything.
+//
 // By default, responses are gzipped regardless of
 // Content-Type.
 func ContentTypes(types []string) Option {
@@ -128,3 +342,291 @@ func ContentTypes(types []string) Option {
 		}
 	}
 }
+
+// StreamingContentTypes specifies content types of streaming responses,
+// such as Server-Sent Events. Streaming responses are compressed
+// right away regardless of MinSize and every Flush of the handler
+// also flushes the compressed data to the client. Content types are
+// matched like in ContentTypes.
+//
+// By default, DefaultStreamingContentTypes are used.
+func StreamingContentTypes(types []string) Option {
+	return func(c *Config) {
+		c.streamingTypes = nil
+		for _, v := range types {
+			mediaType, params, err := mime.ParseMediaType(v)
+			if err == nil {
+				c.streamingTypes = append(c.streamingTypes, parsedContentType{mediaType, params})
+			}
+		}
+	}
+}
+
+// FlushStreamEvents makes streaming responses flush after every write that
+// completes an event, i.e. a blank line for text/event-stream and a newline
+// for other streaming content types, so the handler doesn't have to.
+func FlushStreamEvents(enabled bool) Option {
+	return func(c *Config) {
+		c.flushStreamEvents = enabled
+	}
+}
+
+// MaxFlushLatency makes compressed responses flush when the handler
+// hasn't written anything for the given duration, so the data doesn't
+// get stuck in the compressor of a slow streaming handler that doesn't
+// call Flush itself.
+//
+// By default, compressed data is only flushed on Flush and Close.
+func MaxFlushLatency(d time.Duration) Option {
+	return func(c *Config) {
+		c.flushLatency = d
+	}
+}
+
+// UncompressedTrailers makes compressed responses end with the
+// X-Uncompressed-Length and X-Uncompressed-Crc32 trailers, carrying
+// the length and the hex encoded CRC-32 of the uncompressed body, so
+// clients can verify what they decompressed.
+func UncompressedTrailers(enabled bool) Option {
+	return func(c *Config) {
+		c.uncompressedTrailers = enabled
+	}
+}
+
+// ContentDigest makes compressed responses carry an RFC 9530
+// Content-Digest of the compressed bytes, computed with the given
+// algorithms, "sha-256" and/or "sha-512". The digest is sent as a
+// trailer, or as a header when the whole response was buffered,
+// see BufferResponse. Repr-Digest is left as is.
+//
+// A Content-Digest set by the handler is always removed from compressed
+// responses since it doesn't describe the compressed bytes.
+func ContentDigest(algs ...string) Option {
+	return func(c *Config) {
+		c.digestAlgs = algs
+	}
+}
+
+// PoolResponseWriters makes the ResponseWriters passed to handlers, and
+// their buffers, be reused for other requests once the handlers return, so
+// serving a request doesn't allocate in the steady state. Handlers must then
+// not use the ResponseWriter after they return, e.g. from a goroutine they
+// started, or its writes end up in another client's response.
+//
+// By default, every request gets its own ResponseWriter.
+func PoolResponseWriters(enabled bool) Option {
+	return func(c *Config) {
+		c.poolWriters = enabled
+	}
+}
+
+// BufferResponse makes compressed responses up to the given size be
+// buffered in full before they are sent, so they get a Content-Length
+// and values that are only known at the end, such as Content-Digest,
+// are sent as headers instead of trailers. Larger responses and
+// responses that are flushed are streamed as usual.
+//
+// By default, compressed responses are not buffered.
+func BufferResponse(size int) Option {
+	return func(c *Config) {
+		c.bufferSize = size
+	}
+}
+
+// SkipCrossSite disables compression for requests made by other sites,
+// as told by the Sec-Fetch-Site header or, if it is missing, the Origin
+// and Referer headers. Such requests can be forged by an attacker, who
+// then observes the compressed length of a response that reflects the
+// attacker's input next to a secret, which is known as the BREACH attack.
+func SkipCrossSite(enabled bool) Option {
+	return func(c *Config) {
+		c.skipCrossSite = enabled
+	}
+}
+
+// RandomPadding pads compressed responses with a random number of bytes,
+// up to max, to obscure their length from BREACH attackers. The padding is
+// stored in the extra field of the gzip header, which clients ignore.
+func RandomPadding(max int) Option {
+	return func(c *Config) {
+		c.padding = max
+	}
+}
+
+// AdaptiveLevel lowers the compression level as the number of responses
+// being compressed at the same time grows, so compression doesn't take
+// the CPU the handlers need during traffic spikes. The level goes down
+// linearly from the configured one to gzip.BestSpeed when maxInFlight
+// responses are being compressed, and responses are served uncompressed
+// from twice that number. The level recovers as soon as the load drops.
+func AdaptiveLevel(maxInFlight int) Option {
+	return func(c *Config) {
+		c.adaptiveInFlight = maxInFlight
+	}
+}
+
+// StatelessAbove compresses new responses with gzip.StatelessCompression,
+// which takes very little memory, while n or more responses are already
+// being compressed, so memory use stays flat during traffic spikes.
+func StatelessAbove(n int) Option {
+	return func(c *Config) {
+		c.statelessInFlight = n
+	}
+}
+
+// MaxInFlight limits the number of responses being compressed at the same
+// time, so compression can't starve the server. When the limit is reached,
+// a new response waits up to the given duration for another one to finish
+// and is served uncompressed if that doesn't happen. See Config.Stats for
+// the number of such responses.
+func MaxInFlight(n int, wait time.Duration) Option {
+	return func(c *Config) {
+		c.maxInFlight = n
+		c.semWait = wait
+	}
+}
+
+// LevelPolicy makes the compression level of every response be chosen by
+// the function, see LevelFunc.
+func LevelPolicy(f LevelFunc) Option {
+	return func(c *Config) {
+		c.levelFunc = f
+	}
+}
+
+// ContentTypeRule overrides the compression level and the minimum size
+// for the responses of the content type, see ContentTypeRules.
+type ContentTypeRule struct {
+	// ContentType is matched in the same way as the content types
+	// passed to ContentTypes.
+	ContentType string
+	// Level is the compression level. Zero means the configured one.
+	Level int
+	// MinSize is the minimum size of the response to compress it. Zero
+	// means the configured one and a negative value means any size.
+	MinSize int
+}
+
+// ContentTypeRules specifies compression levels and minimum sizes by
+// content type. E.g., HTML can be compressed at a high level while
+// large JSON exports use a fast one, and small SVG images can be
+// compressed while small JSON responses are not. The first matching
+// rule is used, and responses that match none use the configured
+// level and minimum size.
+func ContentTypeRules(rules ...ContentTypeRule) Option {
+	return func(c *Config) {
+		c.rules = nil
+		for _, r := range rules {
+			mediaType, params, err := mime.ParseMediaType(r.ContentType)
+			if err == nil {
+				c.rules = append(c.rules, contentTypeRule{
+					parsedContentType: parsedContentType{mediaType, params},
+					level:             r.Level,
+					minSize:           r.MinSize,
+				})
+			}
+		}
+	}
+}
+
+// Observe makes the Observer be notified about the compression of every
+// response.
+func Observe(o Observer) Option {
+	return func(c *Config) {
+		c.observer = o
+	}
+}
+
+// Trace makes the Tracer start a span for every response served by
+// Config.Handler. The span is a child of the span in the request context
+// and ends when the response is closed.
+func Trace(t Tracer) Option {
+	return func(c *Config) {
+		c.tracer = t
+	}
+}
+
+// ServerTiming adds a Server-Timing entry with the time spent compressing,
+// e.g. "gzip;dur=1.2", to compressed responses of the requests for which
+// pred returns true. The entry is sent as a header if the whole response
+// is buffered, see BufferResponse, and as a trailer otherwise.
+func ServerTiming(pred func(r *http.Request) bool) Option {
+	return func(c *Config) {
+		c.serverTiming = pred
+	}
+}
+
+// DebugHeaders adds the X-Compression-Ratio header (or trailer, like
+// ServerTiming) to compressed responses and the X-Compression-Skip-Reason
+// header to uncompressed responses of the requests for which pred returns
+// true.
+func DebugHeaders(pred func(r *http.Request) bool) Option {
+	return func(c *Config) {
+		c.debugHeaders = pred
+	}
+}
+
+// Logger makes failures of writing, flushing and closing responses be
+// logged at the error level and compression decisions at the debug level.
+func Logger(l *slog.Logger) Option {
+	return func(c *Config) {
+		c.logger = l
+	}
+}
+
+// OnError makes the ErrorHandler be called with failures of writing,
+// flushing and closing responses.
+func OnError(f ErrorHandler) Option {
+	return func(c *Config) {
+		c.onError = f
+	}
+}
+
+// StopOnDisconnect stops compressing responses once the request context is
+// done, e.g. because the client disconnected. The gzip writer is released
+// right away, subsequent writes fail with err, or ErrDisconnected if err is
+// nil, and the gzip footer is not written.
+func StopOnDisconnect(err error) Option {
+	return func(c *Config) {
+		if err == nil {
+			err = ErrDisconnected
+		}
+		c.stopOnDisconnect = true
+		c.disconnectErr = err
+	}
+}
+
+// SharedEncoderPool makes the Config take gzip writers from the pool, which
+// can be shared with other Configs.
+func SharedEncoderPool(p *EncoderPool) Option {
+	return func(c *Config) {
+		c.encoders = p
+	}
+}
+
+// ParallelCompression compresses responses larger than threshold bytes on
+// several cores. Past the threshold, blocks of blockSize bytes are
+// compressed concurrently by up to workers goroutines, each into a gzip
+// member of its own, which any gzip client decodes as one stream. The
+// defaults are 1MB blocks and GOMAXPROCS workers. Each block is compressed
+// independently, so the compression ratio is a little lower.
+func ParallelCompression(threshold, blockSize, workers int) Option {
+	return func(c *Config) {
+		c.parallelThreshold = threshold
+		c.blockSize = blockSize
+		c.workers = workers
+	}
+}
+
+// AsyncCompression compresses responses on a goroutine of their own, so the
+// handler can produce the next part of the response while the previous one
+// is being compressed. The writes of the handler are collected in a buffer
+// of bufferSize bytes, which is compressed while the handler fills another
+// one. The handler waits if it fills the second buffer before the first
+// one is compressed. Flush and Close compress all the buffered writes
+// before flushing.
+func AsyncCompression(bufferSize int) Option {
+	return func(c *Config) {
+		c.asyncSize = bufferSize
+	}
+}
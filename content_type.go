@@ -1,11 +1,14 @@
 package httpgzip
 
 import (
+	"errors"
 	"fmt"
 	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -14,6 +17,36 @@ const (
 	contentEncoding = "Content-Encoding"
 	contentType     = "Content-Type"
 	contentLength   = "Content-Length"
+	trailer         = "Trailer"
+	contentDigest   = "Content-Digest"
+	secFetchSite    = "Sec-Fetch-Site"
+	origin          = "Origin"
+	serverTiming    = "Server-Timing"
+
+	uncompressedLength = "X-Uncompressed-Length"
+	uncompressedCRC32  = "X-Uncompressed-Crc32"
+
+	compressionRatio      = "X-Compression-Ratio"
+	compressionSkipReason = "X-Compression-Skip-Reason"
+
+	eventStream = "text/event-stream"
+
+	// sniffLen is the number of bytes http.DetectContentType looks at.
+	sniffLen = 512
+)
+
+var (
+	// DefaultStreamingContentTypes are Server-Sent Events and newline
+	// delimited JSON.
+	DefaultStreamingContentTypes = []string{eventStream, "application/x-ndjson"}
+
+	eventDelimiter = []byte("\n\n")
+	lineDelimiter  = []byte("\n")
+	// eventDelimiters are the ways a line ending and a blank line can
+	// follow each other, see isBlankLine.
+	eventDelimiters = [][]byte{eventDelimiter, []byte("\r\r"), []byte("\n\r")}
+
+	errEmptyCoding = errors.New("empty content-coding")
 )
 
 type codings map[string]float64
@@ -31,24 +64,44 @@ const (
 // acceptsGzip returns true if the given HTTP request indicates that it will
 // accept a gzipped response.
 func acceptsGzip(r *http.Request) bool {
-	acceptedEncodings, _ := parseEncodings(r.Header.Get(acceptEncoding))
-	return acceptedEncodings["gzip"] > 0.0
+	// Like parseEncodings(...)["gzip"] > 0, but without allocating.
+	var accepted bool
+	s := r.Header.Get(acceptEncoding)
+	for {
+		part, rest, more := strings.Cut(s, ",")
+		if coding, qvalue, err := parseCoding(part); err == nil && coding == "gzip" {
+			accepted = qvalue > 0.0
+		}
+		if !more {
+			return accepted
+		}
+		s = rest
+	}
+}
+
+// parseContentLength returns the Content-Length or 0 if it is not set.
+func parseContentLength(h http.Header) int {
+	v := h.Get(contentLength)
+	if v == "" {
+		return 0
+	}
+	n, _ := strconv.Atoi(v)
+	return n
 }
 
 // returns true if we've been configured to compress the specific content type.
-func handleContentType(contentTypes []parsedContentType, ct string) bool {
+func handleContentType(contentTypes []parsedContentType, ct *parsedContentType) bool {
 	// If contentTypes is empty we handle all content types.
 	if len(contentTypes) == 0 {
 		return true
 	}
 
-	mediaType, params, err := mime.ParseMediaType(ct)
-	if err != nil {
+	if ct == nil {
 		return false
 	}
 
 	for _, c := range contentTypes {
-		if c.equals(mediaType, params) {
+		if c.equals(ct.mediaType, ct.params) {
 			return true
 		}
 	}
@@ -90,7 +143,9 @@ func parseEncodings(s string) (codings, error) {
 // as might appear in an Accept-Encoding header. It attempts to forgive minor
 // formatting errors.
 func parseCoding(s string) (coding string, qvalue float64, err error) {
-	for n, part := range strings.Split(s, ";") {
+	for n, more := 0, true; more; n++ {
+		var part string
+		part, s, more = strings.Cut(s, ";")
 		part = strings.TrimSpace(part)
 		qvalue = DefaultQValue
 
@@ -108,8 +163,66 @@ func parseCoding(s string) (coding string, qvalue float64, err error) {
 	}
 
 	if coding == "" {
-		err = fmt.Errorf("empty content-coding")
+		err = errEmptyCoding
 	}
 
 	return
 }
+
+// maxMediaTypes bounds the number of cached content types.
+const maxMediaTypes = 256
+
+type parsedMediaType struct {
+	mediaType string
+	params    map[string]string
+	err       error
+}
+
+var (
+	mediaTypesMu sync.Mutex
+	// mediaTypes is replaced on every update, so it can be read without
+	// locking.
+	mediaTypes atomic.Pointer[map[string]parsedMediaType]
+)
+
+// parseMediaType is like mime.ParseMediaType, but caches the results, since
+// responses tend to have a handful of content types, so it doesn't allocate
+// in the steady state. Only content types without parameters other than
+// charset are cached, as parameters such as multipart boundaries can vary
+// between responses. The returned params must not be modified.
+func parseMediaType(ct string) (string, map[string]string, error) {
+	m := mediaTypes.Load()
+	if m != nil {
+		if pmt, ok := (*m)[ct]; ok {
+			return pmt.mediaType, pmt.params, pmt.err
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if !cacheableParams(params) || (m != nil && len(*m) >= maxMediaTypes) {
+		return mediaType, params, err
+	}
+
+	mediaTypesMu.Lock()
+	defer mediaTypesMu.Unlock()
+	var old map[string]parsedMediaType
+	if m := mediaTypes.Load(); m != nil {
+		old = *m
+	}
+	if len(old) < maxMediaTypes {
+		m := make(map[string]parsedMediaType, len(old)+1)
+		for k, v := range old {
+			m[k] = v
+		}
+		m[ct] = parsedMediaType{mediaType: mediaType, params: params, err: err}
+		mediaTypes.Store(&m)
+	}
+	return mediaType, params, err
+}
+
+// cacheableParams reports whether a content type with the parameters can be
+// cached by parseMediaType. A charset has a handful of common values.
+func cacheableParams(params map[string]string) bool {
+	_, charset := params["charset"]
+	return len(params) == 0 || (len(params) == 1 && charset)
+}
@@ -0,0 +1,34 @@
+package httpgzip
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// enabled reports whether the predicate is set and true for the request.
+func enabled(pred func(r *http.Request) bool, r *http.Request) bool {
+	return pred != nil && r != nil && pred(r)
+}
+
+// setDebugHeaders sets the Server-Timing and debug headers of the
+// compressed response, which are trailers unless the whole response was
+// buffered.
+func (w *gzipResponseWriter) setDebugHeaders() {
+	if !w.timing && !w.debug {
+		return
+	}
+	prefix := ""
+	if !w.buffering {
+		prefix = http.TrailerPrefix
+	}
+	h := w.Header()
+	if w.timing {
+		dur := float64(w.dur) / float64(time.Millisecond)
+		h.Add(prefix+serverTiming, "gzip;dur="+strconv.FormatFloat(dur, 'f', 3, 64))
+	}
+	if w.debug && w.bytesOut > 0 {
+		ratio := float64(w.bytesIn) / float64(w.bytesOut)
+		h.Set(prefix+compressionRatio, strconv.FormatFloat(ratio, 'f', 2, 64))
+	}
+}
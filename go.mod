@@ -1,8 +1,13 @@
 module github.com/vmihailenco/httpgzip
 
-go 1.11
+go 1.21
 
 require (
 	github.com/klauspost/compress v1.11.2
 	github.com/stretchr/testify v1.3.0
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+)
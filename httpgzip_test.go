@@ -1,16 +1,30 @@
 package httpgzip
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os"
+	"runtime"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/klauspost/compress/gzip"
 	"github.com/stretchr/testify/require"
@@ -42,6 +56,48 @@ func TestParseEncodings(t *testing.T) {
 	}
 }
 
+func TestAcceptsGzip(t *testing.T) {
+	examples := map[string]bool{
+		"":                        false,
+		"gzip":                    true,
+		"GZIP":                    true,
+		"deflate, gzip;q=0.5":     true,
+		"gzip;q=0, deflate":       false,
+		"gzip;q=0, gzip":          true,
+		"br;q=1.0, gzip;q=1.0":    true,
+		"identity":                false,
+		"gzip;q=invalid, deflate": false,
+	}
+
+	for eg, exp := range examples {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", eg)
+		require.Equal(t, exp, acceptsGzip(r), eg)
+	}
+}
+
+func TestParseMediaTypeCache(t *testing.T) {
+	mediaType, params, err := parseMediaType("multipart/mixed; boundary=cache-test")
+	require.Nil(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+	require.Equal(t, map[string]string{"boundary": "cache-test"}, params)
+	mediaType, _, err = parseMediaType("application/x-cache-test")
+	require.Nil(t, err)
+	require.Equal(t, "application/x-cache-test", mediaType)
+	_, params, err = parseMediaType("text/x-cache-test; charset=utf-8")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"charset": "utf-8"}, params)
+
+	// Parameters vary between responses, so they would fill up the cache.
+	m := *mediaTypes.Load()
+	_, ok := m["multipart/mixed; boundary=cache-test"]
+	require.False(t, ok)
+	_, ok = m["application/x-cache-test"]
+	require.True(t, ok)
+	_, ok = m["text/x-cache-test; charset=utf-8"]
+	require.True(t, ok)
+}
+
 func TestGzipHandler(t *testing.T) {
 	// This just exists to provide something for GzipHandler to wrap.
 	handler := newTestHandler(testBody)
@@ -336,12 +392,225 @@ func TestGzipDoubleClose(t *testing.T) {
 
 	// the second close shouldn't have added the same writer
 	// so we pull out 2 writers from the pool and make sure they're different
-	w1 := c.pool.Get()
-	w2 := c.pool.Get()
+	w1 := c.getWriter(gzip.DefaultCompression)
+	w2 := c.getWriter(gzip.DefaultCompression)
 	// require.NotEqual looks at the value and not the address, so we use regular ==
 	require.False(t, w1 == w2)
 }
 
+func TestAdaptLevel(t *testing.T) {
+	tests := []struct {
+		level, inflight, max int
+		expected             int
+		ok                   bool
+	}{
+		{gzip.BestCompression, 0, 4, gzip.BestCompression, true},
+		{gzip.BestCompression, 2, 4, 5, true},
+		{gzip.BestCompression, 4, 4, gzip.BestSpeed, true},
+		{gzip.BestCompression, 7, 4, gzip.BestSpeed, true},
+		{gzip.BestCompression, 8, 4, 0, false},
+		{gzip.DefaultCompression, 0, 4, 5, true},
+		{gzip.DefaultCompression, 3, 4, 2, true},
+		{gzip.HuffmanOnly, 3, 4, gzip.HuffmanOnly, true},
+	}
+
+	for _, tt := range tests {
+		level, ok := adaptLevel(tt.level, tt.inflight, tt.max)
+		require.Equal(t, tt.ok, ok, "%+v", tt)
+		if ok {
+			require.Equal(t, tt.expected, level, "%+v", tt)
+		}
+	}
+}
+
+func TestAdaptiveLevel(t *testing.T) {
+	c, err := New(AdaptiveLevel(1))
+	require.Nil(t, err)
+
+	start := func() (*httptest.ResponseRecorder, ResponseWriter) {
+		rec := httptest.NewRecorder()
+		w := c.ResponseWriter(rec)
+		io.WriteString(w, testBody)
+		return rec, w
+	}
+
+	rec1, w1 := start()
+	rec2, w2 := start()
+	rec3, w3 := start()
+	require.Nil(t, w3.Close())
+	require.Nil(t, w2.Close())
+	require.Nil(t, w1.Close())
+	rec4, w4 := start()
+	require.Nil(t, w4.Close())
+
+	require.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), rec1.Body.Bytes())
+	require.Equal(t, gzipStrLevel(testBody, gzip.BestSpeed), rec2.Body.Bytes())
+	require.Equal(t, "", rec3.Header().Get("Content-Encoding"))
+	require.Equal(t, testBody, rec3.Body.String())
+	require.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), rec4.Body.Bytes())
+}
+
+func TestLowMemoryLevels(t *testing.T) {
+	for _, lvl := range []int{gzip.HuffmanOnly, gzip.StatelessCompression} {
+		c, err := New(CompressionLevel(lvl))
+		require.Nil(t, err)
+
+		rec := httptest.NewRecorder()
+		w := c.ResponseWriter(rec)
+		io.WriteString(w, testBody[:1000])
+		io.WriteString(w, testBody[1000:])
+		require.Nil(t, w.Close())
+
+		require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		require.Equal(t, testBody, string(gunzip(t, rec.Body.Bytes())))
+	}
+}
+
+func TestLowMemoryLevelsSmallWrites(t *testing.T) {
+	for _, lvl := range []int{gzip.HuffmanOnly, gzip.StatelessCompression} {
+		c, err := New(CompressionLevel(lvl))
+		require.Nil(t, err)
+
+		var body strings.Builder
+		rec := httptest.NewRecorder()
+		w := c.ResponseWriter(rec)
+		for i := 0; i < 2000; i++ {
+			fmt.Fprintf(io.MultiWriter(w, &body), `{"id":%d,"name":"item %d"},`, i, i)
+		}
+
+		// The writes collected so far are written out by Flush.
+		require.Nil(t, http.NewResponseController(w).Flush())
+		require.Equal(t, body.String(), readPartialGzip(t, rec.Body.Bytes(), body.Len()))
+
+		io.WriteString(w, testBody)
+		body.WriteString(testBody)
+		require.Nil(t, w.Close())
+
+		// The writes are compressed together rather than one by one.
+		require.Equal(t, body.String(), string(gunzip(t, rec.Body.Bytes())))
+		require.True(t, rec.Body.Len() < body.Len(), "%d: %d of %d", lvl, rec.Body.Len(), body.Len())
+	}
+}
+
+func TestStatelessAbove(t *testing.T) {
+	o := new(testObserver)
+	c, err := New(StatelessAbove(1), Observe(o))
+	require.Nil(t, err)
+
+	start := func() (*httptest.ResponseRecorder, ResponseWriter) {
+		rec := httptest.NewRecorder()
+		w := c.ResponseWriter(rec)
+		io.WriteString(w, testBody)
+		return rec, w
+	}
+
+	rec1, w1 := start()
+	rec2, w2 := start()
+	require.Nil(t, w2.Close())
+	require.Nil(t, w1.Close())
+	rec3, w3 := start()
+	require.Nil(t, w3.Close())
+
+	require.Equal(t, []int{gzip.DefaultCompression, gzip.StatelessCompression, gzip.DefaultCompression},
+		[]int{o.decisions[0].Level, o.decisions[1].Level, o.decisions[2].Level})
+	for _, rec := range []*httptest.ResponseRecorder{rec1, rec2, rec3} {
+		require.Equal(t, testBody, string(gunzip(t, rec.Body.Bytes())))
+	}
+
+	_, err = New(StatelessAbove(-1))
+	require.Error(t, err)
+}
+
+func TestMaxInFlight(t *testing.T) {
+	c, err := New(MaxInFlight(1, 0))
+	require.Nil(t, err)
+
+	rec1 := httptest.NewRecorder()
+	w1 := c.ResponseWriter(rec1)
+	io.WriteString(w1, testBody)
+	require.Equal(t, Stats{InFlight: 1}, c.Stats())
+
+	rec2 := httptest.NewRecorder()
+	w2 := c.ResponseWriter(rec2)
+	io.WriteString(w2, testBody)
+	require.Nil(t, w2.Close())
+	require.Equal(t, Stats{InFlight: 1, Rejected: 1}, c.Stats())
+	require.Equal(t, "", rec2.Header().Get("Content-Encoding"))
+	require.Equal(t, testBody, rec2.Body.String())
+
+	require.Nil(t, w1.Close())
+	require.Equal(t, Stats{InFlight: 0, Rejected: 1}, c.Stats())
+	require.Equal(t, "gzip", rec1.Header().Get("Content-Encoding"))
+}
+
+func TestMaxInFlightWait(t *testing.T) {
+	c, err := New(MaxInFlight(1, time.Second))
+	require.Nil(t, err)
+
+	w1 := c.ResponseWriter(httptest.NewRecorder())
+	io.WriteString(w1, testBody)
+	time.AfterFunc(10*time.Millisecond, func() { w1.Close() })
+
+	rec2 := httptest.NewRecorder()
+	w2 := c.ResponseWriter(rec2)
+	io.WriteString(w2, testBody)
+	require.Nil(t, w2.Close())
+	require.Equal(t, "gzip", rec2.Header().Get("Content-Encoding"))
+	require.Equal(t, Stats{}, c.Stats())
+}
+
+func TestLevelPolicy(t *testing.T) {
+	var hints []LevelHint
+	c, err := New(CompressionLevel(gzip.BestSpeed), LevelPolicy(func(r *http.Request, hint LevelHint) int {
+		hints = append(hints, hint)
+		if r.URL.Path == "/skip" {
+			return SkipCompression
+		}
+		return gzip.BestCompression
+	}))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, testBody)
+	}))
+
+	for _, path := range []string{"/", "/skip"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		if path == "/skip" {
+			require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+			require.Equal(t, testBody, rec.Body.String())
+		} else {
+			require.Equal(t, gzipStrLevel(testBody, gzip.BestCompression), rec.Body.Bytes())
+		}
+	}
+
+	hint := LevelHint{ContentType: "text/plain", Size: len(testBody), Level: gzip.BestSpeed}
+	require.Equal(t, []LevelHint{hint, hint}, hints)
+	require.Equal(t, Stats{}, c.Stats())
+}
+
+func TestDeadlinePolicy(t *testing.T) {
+	policy := DeadlinePolicy(time.Second)
+	hint := LevelHint{Level: gzip.BestCompression}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	require.Equal(t, gzip.BestCompression, policy(r, hint))
+	require.Equal(t, gzip.BestCompression, policy(nil, hint))
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	require.Equal(t, gzip.BestCompression, policy(r.WithContext(ctx), hint))
+
+	ctx, cancel = context.WithTimeout(r.Context(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, gzip.BestSpeed, policy(r.WithContext(ctx), hint))
+}
+
 type panicOnSecondWriteHeaderWriter struct {
 	http.ResponseWriter
 	headerWritten bool
@@ -389,7 +658,8 @@ func TestGzipHandlerDoubleWriteHeader(t *testing.T) {
 	}
 	require.Empty(t, body)
 	header := rec.Header()
-	require.Equal(t, "gzip", header.Get("Content-Encoding"))
+	// A 304 has no body, so it isn't compressed.
+	require.Equal(t, "", header.Get("Content-Encoding"))
 	require.Equal(t, "Accept-Encoding", header.Get("Vary"))
 	require.Equal(t, 304, rec.Code)
 }
@@ -454,176 +724,1542 @@ func TestNotImplementCloseNotifier(t *testing.T) {
 	})).ServeHTTP(httptest.NewRecorder(), request)
 }
 
-type mockRWCloseNotify struct{}
+func TestResponseController(t *testing.T) {
+	srv := httptest.NewServer(GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		require.Nil(t, rc.SetWriteDeadline(time.Now().Add(time.Minute)))
+		require.Nil(t, rc.SetReadDeadline(time.Now().Add(time.Minute)))
+		require.Nil(t, rc.EnableFullDuplex())
 
-func (m *mockRWCloseNotify) CloseNotify() <-chan bool {
-	panic("implement me")
-}
+		io.WriteString(w, testBody)
+		require.Nil(t, rc.Flush())
+	})))
+	defer srv.Close()
 
-func (m *mockRWCloseNotify) Header() http.Header {
-	return http.Header{}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer res.Body.Close()
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+
+	zr, err := gzip.NewReader(res.Body)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(zr)
+	require.Nil(t, err)
+	require.Equal(t, testBody, string(body))
 }
 
-func (m *mockRWCloseNotify) Write([]byte) (int, error) {
-	panic("implement me")
+type flushErrorWriter struct {
+	*httptest.ResponseRecorder
+	err error
 }
 
-func (m *mockRWCloseNotify) WriteHeader(int) {
-	panic("implement me")
+func (w *flushErrorWriter) FlushError() error {
+	return w.err
 }
 
-func TestIgnoreSubsequentWriteHeader(t *testing.T) {
-	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(500)
-		w.WriteHeader(404)
-	}))
-	r := httptest.NewRequest("GET", "/", nil)
-	r.Header.Set("Accept-Encoding", "gzip")
-	w := httptest.NewRecorder()
-	handler.ServeHTTP(w, r)
+func TestFlushError(t *testing.T) {
+	inner := &flushErrorWriter{httptest.NewRecorder(), fmt.Errorf("flush failed")}
 
-	result := w.Result()
-	if result.StatusCode != 500 {
-		t.Errorf("StatusCode should have been 500 but was %d", result.StatusCode)
-	}
-}
+	c, err := New()
+	require.Nil(t, err)
 
-func TestDontWriteWhenNotWrittenTo(t *testing.T) {
-	// When using gzip as middleware without ANY writes in the handler,
-	// ensure the gzip middleware doesn't touch the actual ResponseWriter
-	// either.
+	w := c.ResponseWriter(inner)
+	require.Equal(t, inner, w.(interface{ Unwrap() http.ResponseWriter }).Unwrap())
 
-	handler0 := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	}))
+	io.WriteString(w, testBody)
+	require.Equal(t, inner.err, http.NewResponseController(w).Flush())
+	require.Nil(t, w.Close())
+}
 
-	handler1 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handler0.ServeHTTP(w, r)
-		w.WriteHeader(404) // this only works if gzip didn't do a WriteHeader(200)
-	})
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom int
+}
 
-	r := httptest.NewRequest("GET", "/", nil)
-	r.Header.Set("Accept-Encoding", "gzip")
-	w := httptest.NewRecorder()
-	handler1.ServeHTTP(w, r)
+func (rec *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rec.readFrom++
+	return rec.Body.ReadFrom(src)
+}
 
-	result := w.Result()
-	if result.StatusCode != 404 {
-		t.Errorf("StatusCode should have been 404 but was %d", result.StatusCode)
-	}
+type pusherRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
 }
 
-var contentTypeTests = []struct {
-	name                 string
-	contentType          string
-	acceptedContentTypes []string
-	expectedGzip         bool
-}{
-	{
-		name:                 "Always gzip when content types are empty",
-		contentType:          "",
-		acceptedContentTypes: []string{},
-		expectedGzip:         true,
-	},
-	{
-		name:                 "MIME match",
-		contentType:          "application/json",
-		acceptedContentTypes: []string{"application/json"},
-		expectedGzip:         true,
-	},
-	{
-		name:                 "MIME no match",
-		contentType:          "text/xml",
-		acceptedContentTypes: []string{"application/json"},
-		expectedGzip:         false,
-	},
-	{
-		name:                 "MIME match with no other directive ignores non-MIME directives",
-		contentType:          "application/json; charset=utf-8",
-		acceptedContentTypes: []string{"application/json"},
-		expectedGzip:         true,
-	},
-	{
-		name:                 "MIME match with other directives requires all directives be equal, different charset",
-		contentType:          "application/json; charset=ascii",
-		acceptedContentTypes: []string{"application/json; charset=utf-8"},
-		expectedGzip:         false,
-	},
-	{
-		name:                 "MIME match with other directives requires all directives be equal, same charset",
-		contentType:          "application/json; charset=utf-8",
-		acceptedContentTypes: []string{"application/json; charset=utf-8"},
-		expectedGzip:         true,
-	},
-	{
-		name:                 "MIME match with other directives requires all directives be equal, missing charset",
-		contentType:          "application/json",
-		acceptedContentTypes: []string{"application/json; charset=ascii"},
-		expectedGzip:         false,
-	},
-	{
-		name:                 "MIME match case insensitive",
-		contentType:          "Application/Json",
-		acceptedContentTypes: []string{"application/json"},
-		expectedGzip:         true,
-	},
-	{
-		name:                 "MIME match ignore whitespace",
-		contentType:          "application/json;charset=utf-8",
-		acceptedContentTypes: []string{"application/json;            charset=utf-8"},
-		expectedGzip:         true,
-	},
+func (rec *pusherRecorder) Push(target string, opts *http.PushOptions) error {
+	rec.pushed = append(rec.pushed, target)
+	return nil
 }
 
-func TestContentTypes(t *testing.T) {
-	for _, tt := range contentTypeTests {
-		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", tt.contentType)
-			io.WriteString(w, testBody)
-		})
+func TestPreserveOptionalInterfaces(t *testing.T) {
+	c, err := New()
+	require.Nil(t, err)
 
-		wrapper, err := GzipHandlerWithOpts(ContentTypes(tt.acceptedContentTypes))
-		require.Nil(t, err, "NewGzipHandlerWithOpts returned error", tt.name)
+	w := c.ResponseWriter(httptest.NewRecorder())
+	_, ok := w.(io.ReaderFrom)
+	require.False(t, ok, "response writer must not implement io.ReaderFrom")
+	_, ok = w.(http.Pusher)
+	require.False(t, ok, "response writer must not implement http.Pusher")
+	_, ok = w.(io.StringWriter)
+	require.True(t, ok, "response writer must implement io.StringWriter")
+
+	w = c.ResponseWriter(&readerFromRecorder{ResponseRecorder: httptest.NewRecorder()})
+	_, ok = w.(io.ReaderFrom)
+	require.True(t, ok, "response writer must implement io.ReaderFrom")
+	_, ok = w.(http.Pusher)
+	require.False(t, ok, "response writer must not implement http.Pusher")
+
+	pusher := &pusherRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w = c.ResponseWriter(pusher)
+	_, ok = w.(io.ReaderFrom)
+	require.False(t, ok, "response writer must not implement io.ReaderFrom")
+	require.Nil(t, w.(http.Pusher).Push("/style.css", nil))
+	require.Equal(t, []string{"/style.css"}, pusher.pushed)
+}
 
-		req, _ := http.NewRequest("GET", "/whatever", nil)
-		req.Header.Set("Accept-Encoding", "gzip")
-		resp := httptest.NewRecorder()
-		wrapper(handler).ServeHTTP(resp, req)
-		res := resp.Result()
+func TestReadFrom(t *testing.T) {
+	for _, ce := range []string{"", "br"} {
+		rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ce != "" {
+				w.Header().Set("Content-Encoding", ce)
+			}
+			n, err := w.(io.ReaderFrom).ReadFrom(bytes.NewReader([]byte(testBody)))
+			require.Nil(t, err)
+			require.Equal(t, int64(len(testBody)), n)
+		}))
 
-		require.Equal(t, 200, res.StatusCode)
-		if tt.expectedGzip {
-			require.Equal(t, "gzip", res.Header.Get("Content-Encoding"), tt.name)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(rec, r)
+
+		if ce == "" {
+			require.Equal(t, 0, rec.readFrom)
+			require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+			require.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), rec.Body.Bytes())
 		} else {
-			require.NotEqual(t, "gzip", res.Header.Get("Content-Encoding"), tt.name)
+			require.Equal(t, 1, rec.readFrom)
+			require.Equal(t, ce, rec.Header().Get("Content-Encoding"))
+			require.Equal(t, testBody, rec.Body.String())
 		}
 	}
 }
 
-// --------------------------------------------------------------------
+func TestTrailers(t *testing.T) {
+	for _, body := range []string{smallTestBody, testBody} {
+		srv := httptest.NewServer(GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Declared")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, body)
+			w.Header().Set("X-Declared", "declared")
+			w.Header().Set(http.TrailerPrefix+"X-Undeclared", "undeclared")
+		})))
 
-func BenchmarkGzipHandler_S2k(b *testing.B)   { benchmark(b, false, 2048) }
-func BenchmarkGzipHandler_S20k(b *testing.B)  { benchmark(b, false, 20480) }
-func BenchmarkGzipHandler_S100k(b *testing.B) { benchmark(b, false, 102400) }
-func BenchmarkGzipHandler_P2k(b *testing.B)   { benchmark(b, true, 2048) }
-func BenchmarkGzipHandler_P20k(b *testing.B)  { benchmark(b, true, 20480) }
-func BenchmarkGzipHandler_P100k(b *testing.B) { benchmark(b, true, 102400) }
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(res.Body)
+		require.Nil(t, err)
+		res.Body.Close()
+		srv.Close()
+
+		require.Equal(t, "", res.Header.Get("X-Declared"))
+		require.Equal(t, "declared", res.Trailer.Get("X-Declared"))
+		require.Equal(t, "undeclared", res.Trailer.Get("X-Undeclared"))
+	}
+}
 
-// --------------------------------------------------------------------
+func TestTrailersBuffered(t *testing.T) {
+	c, err := New(BufferResponse(64<<10), UncompressedTrailers(true))
+	require.Nil(t, err)
 
-func gzipStrLevel(s string, lvl int) []byte {
-	var b bytes.Buffer
-	w, _ := gzip.NewWriterLevel(&b, lvl)
-	io.WriteString(w, s)
-	w.Close()
-	return b.Bytes()
+	srv := httptest.NewServer(c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Declared")
+		io.WriteString(w, testBody)
+		w.Header().Set("X-Declared", "declared")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "undeclared")
+	})))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultTransport.RoundTrip(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	res.Body.Close()
+
+	// The trailers are sent as headers of the buffered response, which has
+	// a Content-Length.
+	require.Equal(t, int64(len(body)), res.ContentLength)
+	require.Equal(t, testBody, string(gunzip(t, body)))
+	require.Equal(t, "declared", res.Header.Get("X-Declared"))
+	require.Equal(t, "undeclared", res.Header.Get("X-Undeclared"))
+	require.Equal(t, strconv.Itoa(len(testBody)), res.Header.Get("X-Uncompressed-Length"))
+	require.Empty(t, res.Header.Get("Trailer"))
+	require.Empty(t, res.Trailer)
 }
 
-func benchmark(b *testing.B, parallel bool, size int) {
-	bin, err := ioutil.ReadFile("testdata/benchmark.json")
-	if err != nil {
-		b.Fatal(err)
-	}
+func TestUncompressedTrailers(t *testing.T) {
+	c, err := New(UncompressedTrailers(true))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody[:1000])
+		io.WriteString(w, testBody[1000:])
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	res := rec.Result()
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	require.Equal(t, strconv.Itoa(len(testBody)), res.Trailer.Get("X-Uncompressed-Length"))
+	require.Equal(t, fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(testBody))), res.Trailer.Get("X-Uncompressed-Crc32"))
+}
+
+func TestContentDigest(t *testing.T) {
+	c, err := New(ContentDigest("sha-256"))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Digest", "sha-256=:uncompressed:")
+		w.Header().Set("Repr-Digest", "sha-256=:representation:")
+		io.WriteString(w, testBody)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	res := rec.Result()
+	sum := sha256.Sum256(rec.Body.Bytes())
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	require.Equal(t, "", res.Header.Get("Content-Digest"))
+	require.Equal(t, "sha-256=:representation:", res.Header.Get("Repr-Digest"))
+	require.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":", res.Trailer.Get("Content-Digest"))
+}
+
+func TestContentDigestBuffered(t *testing.T) {
+	c, err := New(ContentDigest("sha-256", "sha-512"), BufferResponse(64<<10))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	res := rec.Result()
+	sum256 := sha256.Sum256(rec.Body.Bytes())
+	sum512 := sha512.Sum512(rec.Body.Bytes())
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	require.Equal(t, strconv.Itoa(rec.Body.Len()), res.Header.Get("Content-Length"))
+	require.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), rec.Body.Bytes())
+	require.Equal(t, "sha-256=:"+base64.StdEncoding.EncodeToString(sum256[:])+":, "+
+		"sha-512=:"+base64.StdEncoding.EncodeToString(sum512[:])+":", res.Header.Get("Content-Digest"))
+	require.Empty(t, res.Trailer)
+}
+
+func TestBufferResponseOverflow(t *testing.T) {
+	c, err := New(BufferResponse(16))
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, testBody)
+		w.(http.Flusher).Flush()
+		require.Equal(t, http.StatusAccepted, rec.Code)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "", rec.Result().Header.Get("Content-Length"))
+	require.Equal(t, testBody, readPartialGzip(t, rec.Body.Bytes(), len(testBody)))
+}
+
+func TestContentDigestUnsupported(t *testing.T) {
+	_, err := New(ContentDigest("md5"))
+	require.Error(t, err)
+}
+
+func TestSkipCrossSite(t *testing.T) {
+	tests := []struct {
+		header       string
+		value        string
+		expectedGzip bool
+	}{
+		{"", "", true},
+		{"Sec-Fetch-Site", "same-origin", true},
+		{"Sec-Fetch-Site", "cross-site", false},
+		{"Origin", "http://example.com", true},
+		{"Origin", "http://evil.com", false},
+		{"Referer", "http://example.com/page", true},
+		{"Referer", "http://evil.com/page", false},
+	}
+
+	c, err := New(SkipCrossSite(true))
+	require.Nil(t, err)
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}))
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		if tt.expectedGzip {
+			require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), tt.value)
+		} else {
+			require.Equal(t, "", rec.Header().Get("Content-Encoding"), tt.value)
+			require.Equal(t, testBody, rec.Body.String(), tt.value)
+		}
+	}
+}
+
+func TestRandomPadding(t *testing.T) {
+	c, err := New(RandomPadding(100))
+	require.Nil(t, err)
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+	}))
+
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		zr, err := gzip.NewReader(rec.Body)
+		require.Nil(t, err)
+		require.True(t, len(zr.Header.Extra) <= 100)
+		body, err := ioutil.ReadAll(zr)
+		require.Nil(t, err)
+		require.Equal(t, testBody, string(body))
+	}
+
+	_, err = New(RandomPadding(1 << 16))
+	require.Error(t, err)
+}
+
+func TestMarkSecret(t *testing.T) {
+	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, MarkSecret(w))
+		io.WriteString(w, testBody)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, testBody, rec.Body.String())
+
+	handler = GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+		require.Equal(t, ErrCompressionStarted, MarkSecret(w))
+	}))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Nil(t, MarkSecret(rec))
+}
+
+type poolObserver struct {
+	testObserver
+	allocs []bool
+}
+
+func (o *poolObserver) PoolGet(level int, allocated bool) {
+	o.allocs = append(o.allocs, allocated)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	o := new(poolObserver)
+	c, err := New(Observe(o), MaxInFlight(1, 0))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			io.WriteString(w, smallTestBody)
+		} else {
+			io.WriteString(w, testBody)
+		}
+		panic(http.ErrAbortHandler)
+	}))
+
+	for _, path := range []string{"/", "/small", "/"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		func() {
+			defer func() {
+				require.Equal(t, http.ErrAbortHandler, recover())
+			}()
+			handler.ServeHTTP(rec, r)
+		}()
+
+		if path == "/small" {
+			// The buffered body is not written.
+			require.Equal(t, 0, rec.Body.Len())
+			require.False(t, rec.Flushed)
+			continue
+		}
+		// The gzip footer is not written.
+		gr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+		if err == nil {
+			_, err = io.ReadAll(gr)
+		}
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%v", err)
+	}
+
+	// The aborted gzip writers are not put back into the pool and the
+	// MaxInFlight slot is released.
+	require.Equal(t, []bool{true, true}, o.allocs)
+	require.Equal(t, Stats{}, c.Stats())
+	require.Empty(t, o.results)
+}
+
+func TestStopOnDisconnect(t *testing.T) {
+	errGone := errors.New("gone")
+	c, err := New(StopOnDisconnect(errGone), MaxInFlight(1, 0))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testBody)
+		require.Nil(t, err)
+		require.Equal(t, Stats{InFlight: 1}, c.Stats())
+
+		cancel()
+		_, err = io.WriteString(w, testBody)
+		require.Equal(t, errGone, err)
+		// The compression level is released right away.
+		require.Equal(t, Stats{}, c.Stats())
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, Stats{}, c.Stats())
+	// The gzip footer is not written.
+	gr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	require.Nil(t, err)
+	_, err = io.ReadAll(gr)
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%v", err)
+
+	c, err = New(StopOnDisconnect(nil))
+	require.Nil(t, err)
+	w := c.newResponseWriter(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusOK)
+	_, err = io.WriteString(w, testBody)
+	require.Equal(t, ErrDisconnected, err)
+	require.Nil(t, w.Close())
+}
+
+func TestStopOnDisconnectWithoutWrite(t *testing.T) {
+	c, err := New(StopOnDisconnect(nil), MaxInFlight(1, 0))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testBody)
+		require.Nil(t, err)
+		require.Equal(t, Stats{InFlight: 1}, c.Stats())
+
+		// The compression level is released while the handler is still
+		// waiting, without another write.
+		cancel()
+		deadline := time.Now().Add(time.Second)
+		for c.Stats() != (Stats{}) {
+			if time.Now().After(deadline) {
+				t.Fatal("compression level was not released")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, Stats{}, c.Stats())
+}
+
+func TestPutResponseWriter(t *testing.T) {
+	c, err := New(PoolResponseWriters(true))
+	require.Nil(t, err)
+
+	w := c.newResponseWriter(httptest.NewRecorder(), nil)
+	io.WriteString(w, smallTestBody)
+	require.Equal(t, DefaultMinSize, cap(w.spare))
+	require.Nil(t, w.Close())
+
+	c.putResponseWriter(w)
+	require.Equal(t, &gzipResponseWriter{spare: w.spare}, w)
+	require.Len(t, w.spare, 0)
+
+	// The writers keep no state of previous responses.
+	rec := httptest.NewRecorder()
+	w = c.newResponseWriter(rec, nil)
+	io.WriteString(w, testBody)
+	require.Nil(t, w.Close())
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), rec.Body.Bytes())
+
+	rec = httptest.NewRecorder()
+	w = c.newResponseWriter(rec, nil)
+	io.WriteString(w, smallTestBody)
+	require.Nil(t, w.Close())
+	require.Equal(t, smallTestBody, rec.Body.String())
+
+	// Large buffers are not kept.
+	w.spare = make([]byte, 0, maxSpareSize+1)
+	c.putResponseWriter(w)
+	require.Nil(t, w.spare)
+}
+
+func TestResponseWritersNotPooled(t *testing.T) {
+	c, err := New()
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	w := c.newResponseWriter(rec, nil)
+	io.WriteString(w, smallTestBody)
+	require.Nil(t, w.Close())
+	c.putResponseWriter(w)
+
+	// A handler that keeps the writer can't write into another response.
+	require.True(t, w != c.newResponseWriter(httptest.NewRecorder(), nil))
+	require.True(t, w.closed)
+}
+
+func TestSharedEncoderPool(t *testing.T) {
+	p := NewEncoderPool(2)
+	require.Nil(t, p.Prewarm(gzip.BestSpeed, 3))
+	require.Error(t, p.Prewarm(42, 1))
+	require.Equal(t, EncoderPoolStats{Allocs: 3, Idle: 2}, p.Stats())
+
+	c1, err := New(SharedEncoderPool(p), CompressionLevel(gzip.BestSpeed))
+	require.Nil(t, err)
+	c2, err := New(SharedEncoderPool(p), CompressionLevel(gzip.BestSpeed))
+	require.Nil(t, err)
+
+	w1 := c1.getWriter(gzip.BestSpeed)
+	w2 := c2.getWriter(gzip.BestSpeed)
+	w3 := c2.getWriter(gzip.BestSpeed)
+	require.Equal(t, EncoderPoolStats{Allocs: 4, Reuses: 2}, p.Stats())
+
+	// Writers over maxIdle are dropped.
+	c1.putWriter(w1, gzip.BestSpeed)
+	c2.putWriter(w2, gzip.BestSpeed)
+	c2.putWriter(w3, gzip.BestSpeed)
+	require.Equal(t, EncoderPoolStats{Allocs: 4, Reuses: 2, Idle: 2}, p.Stats())
+
+	for _, c := range []*Config{c1, c2} {
+		rec := httptest.NewRecorder()
+		w := c.ResponseWriter(rec)
+		io.WriteString(w, testBody)
+		require.Nil(t, w.Close())
+		require.Equal(t, gzipStrLevel(testBody, gzip.BestSpeed), rec.Body.Bytes())
+	}
+	require.Equal(t, EncoderPoolStats{Allocs: 4, Reuses: 4, Idle: 2}, p.Stats())
+}
+
+func TestPrewarm(t *testing.T) {
+	p := NewEncoderPool(1)
+	require.Nil(t, p.Prewarm(gzip.BestCompression, 1))
+	c, err := New(SharedEncoderPool(p), CompressionLevel(gzip.BestCompression))
+	require.Nil(t, err)
+
+	// The compressor of a gzip writer, which takes ~1MB at this level, is
+	// allocated by Prewarm rather than by the first response.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	rec := httptest.NewRecorder()
+	w := c.ResponseWriter(rec)
+	io.WriteString(w, testBody)
+	require.Nil(t, w.Close())
+	runtime.ReadMemStats(&after)
+
+	require.Equal(t, gzipStrLevel(testBody, gzip.BestCompression), rec.Body.Bytes())
+	require.True(t, after.TotalAlloc-before.TotalAlloc < 64<<10, "%d", after.TotalAlloc-before.TotalAlloc)
+	require.Equal(t, EncoderPoolStats{Allocs: 1, Reuses: 1, Idle: 1}, p.Stats())
+}
+
+func TestParallelCompression(t *testing.T) {
+	body := strings.Repeat(testBody, 10)
+	c, err := New(ParallelCompression(1000, 4096, 3), UncompressedTrailers(true))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body[:500])
+		io.WriteString(w, body[500:10000])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body[10000:])
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, body, string(gunzip(t, rec.Body.Bytes())))
+	res := rec.Result()
+	require.Equal(t, strconv.Itoa(len(body)), res.Trailer.Get("X-Uncompressed-Length"))
+	require.Equal(t, fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))), res.Trailer.Get("X-Uncompressed-Crc32"))
+
+	// The first 1000 bytes make up the first member, the rest is split into
+	// blocks of 4096 bytes, except for the one cut short by the flush.
+	var sizes []int
+	br := bufio.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	zr, err := gzip.NewReader(br)
+	require.Nil(t, err)
+	for {
+		zr.Multistream(false)
+		b, err := io.ReadAll(zr)
+		require.Nil(t, err)
+		sizes = append(sizes, len(b))
+		if err := zr.Reset(br); err == io.EOF {
+			break
+		}
+	}
+	rest := len(body) - 10000
+	expected := []int{1000, 4096, 4096, 9000 - 2*4096}
+	for ; rest > 4096; rest -= 4096 {
+		expected = append(expected, 4096)
+	}
+	expected = append(expected, rest)
+	require.Equal(t, expected, sizes)
+
+	_, err = New(ParallelCompression(1, -1, 0))
+	require.Error(t, err)
+}
+
+func TestAsyncCompression(t *testing.T) {
+	body := strings.Repeat(testBody, 10)
+	c, err := New(AsyncCompression(1000), UncompressedTrailers(true))
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10000; i += 300 {
+			io.WriteString(w, body[i:i+300])
+		}
+		w.(http.Flusher).Flush()
+		require.Equal(t, body[:10200], readPartialGzip(t, rec.Body.Bytes(), 10200))
+		io.WriteString(w, body[10200:])
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, body, string(gunzip(t, rec.Body.Bytes())))
+	res := rec.Result()
+	require.Equal(t, strconv.Itoa(len(body)), res.Trailer.Get("X-Uncompressed-Length"))
+	require.Equal(t, fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))), res.Trailer.Get("X-Uncompressed-Crc32"))
+
+	_, err = New(AsyncCompression(-1))
+	require.Error(t, err)
+	_, err = New(AsyncCompression(1000), ParallelCompression(1000, 0, 0))
+	require.Error(t, err)
+}
+
+func TestAsyncCompressionDisconnect(t *testing.T) {
+	c, err := New(AsyncCompression(100), StopOnDisconnect(nil), MaxInFlight(1, 0))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testBody)
+		require.Nil(t, err)
+		cancel()
+		_, err = io.WriteString(w, testBody)
+		require.Equal(t, ErrDisconnected, err)
+		require.Equal(t, Stats{}, c.Stats())
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal(t, Stats{}, c.Stats())
+}
+
+type mockRWCloseNotify struct{}
+
+func (m *mockRWCloseNotify) CloseNotify() <-chan bool {
+	panic("implement me")
+}
+
+func (m *mockRWCloseNotify) Header() http.Header {
+	return http.Header{}
+}
+
+func (m *mockRWCloseNotify) Write([]byte) (int, error) {
+	panic("implement me")
+}
+
+func (m *mockRWCloseNotify) WriteHeader(int) {
+	panic("implement me")
+}
+
+func TestIgnoreSubsequentWriteHeader(t *testing.T) {
+	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		w.WriteHeader(404)
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	result := w.Result()
+	if result.StatusCode != 500 {
+		t.Errorf("StatusCode should have been 500 but was %d", result.StatusCode)
+	}
+}
+
+func TestInformationalStatusCodes(t *testing.T) {
+	srv := httptest.NewServer(GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, testBody)
+	})))
+	defer srv.Close()
+
+	var informational []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			informational = append(informational, code)
+			return nil
+		},
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, []int{http.StatusEarlyHints}, informational)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+}
+
+func TestDontWriteWhenNotWrittenTo(t *testing.T) {
+	// When using gzip as middleware without ANY writes in the handler,
+	// ensure the gzip middleware doesn't touch the actual ResponseWriter
+	// either.
+
+	handler0 := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+
+	handler1 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler0.ServeHTTP(w, r)
+		w.WriteHeader(404) // this only works if gzip didn't do a WriteHeader(200)
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler1.ServeHTTP(w, r)
+
+	result := w.Result()
+	if result.StatusCode != 404 {
+		t.Errorf("StatusCode should have been 404 but was %d", result.StatusCode)
+	}
+}
+
+func TestDecideAtWriteHeader(t *testing.T) {
+	tests := []struct {
+		name            string
+		header          map[string]string
+		contentEncoding string
+	}{
+		{"already encoded", map[string]string{"Content-Encoding": "br"}, "br"},
+		{"unhandled content type", map[string]string{"Content-Type": "image/png"}, ""},
+		{"small content length", map[string]string{"Content-Length": "10"}, ""},
+		{"large content length", map[string]string{"Content-Type": "text/plain", "Content-Length": "1000"}, "gzip"},
+	}
+
+	c, err := New(ContentTypes([]string{"text/plain"}))
+	require.Nil(t, err)
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range tt.header {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			require.Equal(t, http.StatusAccepted, rec.Code, tt.name)
+
+			io.WriteString(w, "hello")
+			if tt.contentEncoding != "gzip" {
+				require.Equal(t, "hello", rec.Body.String(), tt.name)
+			}
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(rec, r)
+
+		require.Equal(t, tt.contentEncoding, rec.Result().Header.Get("Content-Encoding"), tt.name)
+	}
+}
+
+func TestBodylessStatusCodes(t *testing.T) {
+	for _, code := range []int{http.StatusNoContent, http.StatusNotModified} {
+		o := new(testObserver)
+		c, err := New(Observe(o))
+		require.Nil(t, err)
+		handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Length", "10000")
+			w.WriteHeader(code)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		require.Equal(t, code, rec.Code)
+		require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+		require.Equal(t, "10000", rec.Header().Get("Content-Length"))
+		require.Equal(t, 0, rec.Body.Len())
+		require.Equal(t, []Decision{{Reason: ReasonNoBody}}, o.decisions)
+	}
+	require.Equal(t, "no-body", ReasonNoBody.String())
+}
+
+func TestDecideAtFirstWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		io.WriteString(w, "hello")
+		require.Equal(t, "hello", rec.Body.String())
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "br", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "hello", rec.Body.String())
+}
+
+func TestWriteAfterEmptyGzipWrite(t *testing.T) {
+	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(testBody)))
+		w.Write(nil)
+		io.WriteString(w, testBody)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, gzipStrLevel(testBody, gzip.DefaultCompression), rec.Body.Bytes())
+}
+
+func TestMediaType(t *testing.T) {
+	c, err := New()
+	require.Nil(t, err)
+
+	w := c.newResponseWriter(httptest.NewRecorder(), nil)
+	require.Nil(t, w.mediaType())
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary=abc")
+	require.Equal(t, &parsedContentType{mediaType: "multipart/mixed", params: map[string]string{"boundary": "abc"}}, w.mediaType())
+	// The header is only parsed again when it changes.
+	require.Equal(t, 0.0, testing.AllocsPerRun(10, func() { w.mediaType() }))
+
+	w.Header().Set("Content-Type", "text/plain")
+	require.Equal(t, &parsedContentType{mediaType: "text/plain", params: map[string]string{}}, w.mediaType())
+}
+
+func TestStreamingContentTypes(t *testing.T) {
+	const event = "data: hello\n\n"
+
+	for _, ct := range DefaultStreamingContentTypes {
+		rec := httptest.NewRecorder()
+		handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			require.True(t, rec.Flushed, ct)
+			require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), ct)
+
+			io.WriteString(w, event)
+			w.(http.Flusher).Flush()
+			require.Equal(t, event, readPartialGzip(t, rec.Body.Bytes(), len(event)), ct)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(rec, r)
+	}
+}
+
+func TestFlushStreamEvents(t *testing.T) {
+	c, err := New(FlushStreamEvents(true))
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		io.WriteString(w, "data: 1\n\n")
+		require.Equal(t, "data: 1\n\n", readPartialGzip(t, rec.Body.Bytes(), 9))
+
+		// The delimiter is split across writes.
+		io.WriteString(w, "data: 2\n")
+		io.WriteString(w, "\n")
+		require.Equal(t, "data: 1\n\ndata: 2\n\n", readPartialGzip(t, rec.Body.Bytes(), 18))
+
+		// Events can be delimited by CRLF pairs too.
+		io.WriteString(w, "data: 3\r\n\r\n")
+		require.Equal(t, "data: 1\n\ndata: 2\n\ndata: 3\r\n\r\n", readPartialGzip(t, rec.Body.Bytes(), 29))
+		io.WriteString(w, "data: 4\r\n")
+		io.WriteString(w, "\r\n")
+		require.Equal(t, "data: 1\n\ndata: 2\n\ndata: 3\r\n\r\ndata: 4\r\n\r\n", readPartialGzip(t, rec.Body.Bytes(), 40))
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, r)
+}
+
+func TestFlushStreamWithoutEvents(t *testing.T) {
+	c, err := New()
+	require.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Server-sent events handlers flush the headers without calling
+		// WriteHeader.
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+
+		require.True(t, rec.Flushed)
+		require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		require.Equal(t, []byte{0x1f, 0x8b}, rec.Body.Bytes()[:2])
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, r)
+
+	require.Empty(t, gunzip(t, rec.Body.Bytes()))
+}
+
+func TestStreamWithoutEventsNotFlushed(t *testing.T) {
+	c, err := New()
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Empty(t, gunzip(t, rec.Body.Bytes()))
+}
+
+func TestStreamingContentTypeExcluded(t *testing.T) {
+	c, err := New(ContentTypes([]string{"text/html"}))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "data: 1\n\n", rec.Body.String())
+}
+
+type notifyFlushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan struct{}
+}
+
+func (rec *notifyFlushRecorder) Flush() {
+	rec.ResponseRecorder.Flush()
+	rec.flushed <- struct{}{}
+}
+
+func TestMaxFlushLatency(t *testing.T) {
+	c, err := New(MaxFlushLatency(10 * time.Millisecond))
+	require.Nil(t, err)
+
+	rec := &notifyFlushRecorder{httptest.NewRecorder(), make(chan struct{}, 1)}
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+
+		select {
+		case <-rec.flushed:
+		case <-time.After(time.Second):
+			t.Fatal("response was not flushed")
+		}
+		require.Equal(t, testBody, readPartialGzip(t, rec.Body.Bytes(), len(testBody)))
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, r)
+
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+}
+
+func TestMaxFlushLatencyBuffered(t *testing.T) {
+	c, err := New(MaxFlushLatency(time.Millisecond), BufferResponse(64<<10))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testBody)
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("X-Late", "1")
+		io.WriteString(w, testBody)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	// The buffered response isn't flushed by the timer, so it still gets
+	// the late header and its Content-Length.
+	require.Equal(t, "1", rec.Header().Get("X-Late"))
+	require.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+	require.Equal(t, testBody+testBody, string(gunzip(t, rec.Body.Bytes())))
+}
+
+var contentTypeTests = []struct {
+	name                 string
+	contentType          string
+	acceptedContentTypes []string
+	expectedGzip         bool
+}{
+	{
+		name:                 "Always gzip when content types are empty",
+		contentType:          "",
+		acceptedContentTypes: []string{},
+		expectedGzip:         true,
+	},
+	{
+		name:                 "MIME match",
+		contentType:          "application/json",
+		acceptedContentTypes: []string{"application/json"},
+		expectedGzip:         true,
+	},
+	{
+		name:                 "MIME no match",
+		contentType:          "text/xml",
+		acceptedContentTypes: []string{"application/json"},
+		expectedGzip:         false,
+	},
+	{
+		name:                 "MIME match with no other directive ignores non-MIME directives",
+		contentType:          "application/json; charset=utf-8",
+		acceptedContentTypes: []string{"application/json"},
+		expectedGzip:         true,
+	},
+	{
+		name:                 "MIME match with other directives requires all directives be equal, different charset",
+		contentType:          "application/json; charset=ascii",
+		acceptedContentTypes: []string{"application/json; charset=utf-8"},
+		expectedGzip:         false,
+	},
+	{
+		name:                 "MIME match with other directives requires all directives be equal, same charset",
+		contentType:          "application/json; charset=utf-8",
+		acceptedContentTypes: []string{"application/json; charset=utf-8"},
+		expectedGzip:         true,
+	},
+	{
+		name:                 "MIME match with other directives requires all directives be equal, missing charset",
+		contentType:          "application/json",
+		acceptedContentTypes: []string{"application/json; charset=ascii"},
+		expectedGzip:         false,
+	},
+	{
+		name:                 "MIME match case insensitive",
+		contentType:          "Application/Json",
+		acceptedContentTypes: []string{"application/json"},
+		expectedGzip:         true,
+	},
+	{
+		name:                 "MIME match ignore whitespace",
+		contentType:          "application/json;charset=utf-8",
+		acceptedContentTypes: []string{"application/json;            charset=utf-8"},
+		expectedGzip:         true,
+	},
+	{
+		name:                 "MIME match wildcard subtype",
+		contentType:          "application/json",
+		acceptedContentTypes: []string{"application/*"},
+		expectedGzip:         true,
+	},
+	{
+		name:                 "MIME no match wildcard subtype",
+		contentType:          "applicationx/json",
+		acceptedContentTypes: []string{"application/*"},
+		expectedGzip:         false,
+	},
+	{
+		name:                 "MIME match wildcard",
+		contentType:          "image/svg+xml",
+		acceptedContentTypes: []string{"*/*"},
+		expectedGzip:         true,
+	},
+}
+
+func TestContentTypes(t *testing.T) {
+	for _, tt := range contentTypeTests {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Content-Type", tt.contentType)
+			io.WriteString(w, testBody)
+		})
+
+		wrapper, err := GzipHandlerWithOpts(ContentTypes(tt.acceptedContentTypes))
+		require.Nil(t, err, "NewGzipHandlerWithOpts returned error", tt.name)
+
+		req, _ := http.NewRequest("GET", "/whatever", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		wrapper(handler).ServeHTTP(resp, req)
+		res := resp.Result()
+
+		require.Equal(t, 200, res.StatusCode)
+		if tt.expectedGzip {
+			require.Equal(t, "gzip", res.Header.Get("Content-Encoding"), tt.name)
+		} else {
+			require.NotEqual(t, "gzip", res.Header.Get("Content-Encoding"), tt.name)
+		}
+	}
+}
+
+func TestContentTypeRules(t *testing.T) {
+	c, err := New(ContentTypeRules(
+		ContentTypeRule{ContentType: "image/svg+xml", MinSize: 10},
+		ContentTypeRule{ContentType: "application/*", Level: gzip.BestSpeed, MinSize: 1000},
+		ContentTypeRule{ContentType: "text/html", Level: gzip.BestCompression, MinSize: 100},
+	))
+	require.Nil(t, err)
+
+	tests := []struct {
+		contentType string
+		body        string
+		level       int
+	}{
+		{"image/svg+xml", testBody[:50], gzip.DefaultCompression},
+		{"application/json", testBody[:500], SkipCompression},
+		{"application/json", testBody, gzip.BestSpeed},
+		{"text/html", testBody, gzip.BestCompression},
+		{"", smallTestBody, SkipCompression},
+		{"", testBody, gzip.DefaultCompression},
+	}
+
+	for _, tt := range tests {
+		handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType != "" {
+				w.Header().Set("Content-Type", tt.contentType)
+			}
+			io.WriteString(w, tt.body)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		if tt.level == SkipCompression {
+			require.Equal(t, "", rec.Header().Get("Content-Encoding"), tt.contentType)
+			require.Equal(t, tt.body, rec.Body.String(), tt.contentType)
+		} else {
+			require.Equal(t, gzipStrLevel(tt.body, tt.level), rec.Body.Bytes(), tt.contentType)
+		}
+	}
+
+	_, err = New(ContentTypeRules(ContentTypeRule{ContentType: "text/html", Level: 42}))
+	require.Error(t, err)
+}
+
+func TestContentTypeRuleMinSize(t *testing.T) {
+	c, err := New(ContentTypeRules(
+		ContentTypeRule{ContentType: "text/html", Level: gzip.BestCompression},
+		ContentTypeRule{ContentType: "image/svg+xml", MinSize: -1},
+	))
+	require.Nil(t, err)
+
+	tests := []struct {
+		contentType string
+		code        int
+		body        string
+		gzip        bool
+	}{
+		// A rule without MinSize uses the configured one.
+		{"text/html", http.StatusOK, "hi", false},
+		{"text/html", http.StatusOK, testBody, true},
+		{"text/html", http.StatusNoContent, "", false},
+		// A negative MinSize compresses responses of any size.
+		{"image/svg+xml", http.StatusOK, "hi", true},
+	}
+
+	for _, tt := range tests {
+		handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			w.WriteHeader(tt.code)
+			io.WriteString(w, tt.body)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		require.Equal(t, tt.code, rec.Code)
+		if tt.gzip {
+			require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), tt.body)
+			require.Equal(t, tt.body, string(gunzip(t, rec.Body.Bytes())))
+		} else {
+			require.Equal(t, "", rec.Header().Get("Content-Encoding"), tt.body)
+			require.Equal(t, tt.body, rec.Body.String())
+		}
+	}
+}
+
+type testObserver struct {
+	decisions []Decision
+	results   []Result
+}
+
+func (o *testObserver) Decided(r *http.Request, d Decision) {
+	o.decisions = append(o.decisions, d)
+}
+
+func (o *testObserver) Completed(r *http.Request, res Result) {
+	o.results = append(o.results, res)
+}
+
+func TestObserver(t *testing.T) {
+	o := new(testObserver)
+	c, err := New(Observe(o))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			io.WriteString(w, smallTestBody)
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "br")
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, testBody)
+		default:
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, testBody)
+		}
+	}))
+
+	var size int64
+	for _, path := range []string{"/", "/small", "/encoded", "/no-accept"} {
+		r := httptest.NewRequest("GET", path, nil)
+		if path != "/no-accept" {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if path == "/" {
+			size = int64(rec.Body.Len())
+		}
+	}
+
+	require.Equal(t, []Decision{
+		{Compressed: true, Level: gzip.DefaultCompression},
+		{Reason: ReasonTooSmall},
+		{Reason: ReasonAlreadyEncoded},
+		{Reason: ReasonNoAccept},
+	}, o.decisions)
+
+	require.Len(t, o.results, 3)
+	require.True(t, o.results[0].Duration > 0)
+	o.results[0].Duration = 0
+	require.Equal(t, []Result{
+		{Coding: "gzip", StatusCode: http.StatusCreated, BytesIn: int64(len(testBody)), BytesOut: size},
+		{Coding: "identity", StatusCode: http.StatusOK, BytesIn: int64(len(smallTestBody)), BytesOut: int64(len(smallTestBody))},
+		{Coding: "identity", StatusCode: http.StatusAccepted, BytesIn: int64(len(testBody)), BytesOut: int64(len(testBody))},
+	}, o.results)
+	require.Equal(t, "too-small", ReasonTooSmall.String())
+}
+
+type testTracer struct {
+	parents []context.Context
+	spans   []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &testSpan{name: name, attrs: make(map[string]any)}
+	tr.parents = append(tr.parents, ctx)
+	tr.spans = append(tr.spans, span)
+	return ctx, span
+}
+
+type testSpan struct {
+	name  string
+	attrs map[string]any
+	ended bool
+}
+
+func (s *testSpan) SetAttribute(key string, value any) { s.attrs[key] = value }
+func (s *testSpan) End()                               { s.ended = true }
+
+func TestTrace(t *testing.T) {
+	tr := new(testTracer)
+	c, err := New(Trace(tr))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			io.WriteString(w, smallTestBody)
+			return
+		}
+		io.WriteString(w, testBody)
+	}))
+
+	type ctxKey struct{}
+	var sizes []int64
+	for _, path := range []string{"/", "/small"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, path))
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		sizes = append(sizes, int64(rec.Body.Len()))
+	}
+
+	require.Len(t, tr.spans, 2)
+	require.Equal(t, "/", tr.parents[0].Value(ctxKey{}))
+	require.Equal(t, "/small", tr.parents[1].Value(ctxKey{}))
+	require.Equal(t, &testSpan{name: "httpgzip.response", ended: true, attrs: map[string]any{
+		AttrCoding:   "gzip",
+		AttrLevel:    gzip.DefaultCompression,
+		AttrBytesIn:  int64(len(testBody)),
+		AttrBytesOut: sizes[0],
+	}}, tr.spans[0])
+	require.Equal(t, &testSpan{name: "httpgzip.response", ended: true, attrs: map[string]any{
+		AttrCoding:     "identity",
+		AttrSkipReason: "too-small",
+		AttrBytesIn:    int64(len(smallTestBody)),
+		AttrBytesOut:   sizes[1],
+	}}, tr.spans[1])
+}
+
+func TestServerTiming(t *testing.T) {
+	internal := func(r *http.Request) bool { return r.Header.Get("X-Internal") != "" }
+	serve := func(t *testing.T, c *Config, internal bool) *http.Response {
+		handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testBody)
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if internal {
+			r.Header.Set("X-Internal", "1")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Result()
+	}
+
+	t.Run("trailer", func(t *testing.T) {
+		c, err := New(ServerTiming(internal), DebugHeaders(internal))
+		require.Nil(t, err)
+
+		res := serve(t, c, true)
+		require.Regexp(t, `^gzip;dur=\d+\.\d{3}$`, res.Trailer.Get("Server-Timing"))
+		require.Regexp(t, `^\d+\.\d{2}$`, res.Trailer.Get("X-Compression-Ratio"))
+		require.Empty(t, res.Header.Get("Server-Timing"))
+
+		res = serve(t, c, false)
+		require.Empty(t, res.Trailer)
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		c, err := New(ServerTiming(internal), DebugHeaders(internal), BufferResponse(64<<10))
+		require.Nil(t, err)
+
+		res := serve(t, c, true)
+		require.Regexp(t, `^gzip;dur=\d+\.\d{3}$`, res.Header.Get("Server-Timing"))
+		require.Regexp(t, `^\d+\.\d{2}$`, res.Header.Get("X-Compression-Ratio"))
+		require.Empty(t, res.Trailer)
+	})
+}
+
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestOnError(t *testing.T) {
+	type failure struct {
+		path string
+		op   string
+		err  string
+	}
+	var failures []failure
+	var logs bytes.Buffer
+	c, err := New(
+		OnError(func(r *http.Request, op string, err error) {
+			failures = append(failures, failure{r.URL.Path, op, err.Error()})
+		}),
+		Logger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			io.WriteString(w, smallTestBody)
+			return
+		}
+		io.WriteString(w, testBody)
+		io.WriteString(w, testBody)
+		w.(http.Flusher).Flush()
+	}))
+
+	for _, path := range []string{"/", "/small"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(failingWriter{httptest.NewRecorder()}, r)
+	}
+
+	require.Equal(t, []failure{
+		{"/", "write", "connection reset"},
+		{"/", "flush", "connection reset"},
+		{"/", "close", "connection reset"},
+		{"/small", "close", `gziphandler: write to regular responseWriter at close gets error: "connection reset"`},
+	}, failures)
+	require.Contains(t, logs.String(), `level=DEBUG msg="httpgzip: decided" method=GET path=/ remote_addr=192.0.2.1:1234 compressed=true level=-1`)
+	require.Contains(t, logs.String(), `level=DEBUG msg="httpgzip: decided" method=GET path=/small remote_addr=192.0.2.1:1234 compressed=false reason=too-small`)
+	require.Contains(t, logs.String(), `level=ERROR msg="httpgzip: flush failed" method=GET path=/ remote_addr=192.0.2.1:1234 error="connection reset"`)
+}
+
+func TestDebugHeadersSkipReason(t *testing.T) {
+	c, err := New(DebugHeaders(func(r *http.Request) bool { return true }))
+	require.Nil(t, err)
+
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, smallTestBody)
+	}))
+
+	for accept, reason := range map[string]string{"gzip": "too-small", "": "no-accept"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		require.Equal(t, reason, rec.Result().Header.Get("X-Compression-Skip-Reason"))
+		require.Equal(t, smallTestBody, rec.Body.String())
+	}
+}
+
+// --------------------------------------------------------------------
+
+func BenchmarkGzipHandler_S2k(b *testing.B)   { benchmark(b, false, 2048) }
+func BenchmarkGzipHandler_S20k(b *testing.B)  { benchmark(b, false, 20480) }
+func BenchmarkGzipHandler_S100k(b *testing.B) { benchmark(b, false, 102400) }
+func BenchmarkGzipHandler_P2k(b *testing.B)   { benchmark(b, true, 2048) }
+func BenchmarkGzipHandler_P20k(b *testing.B)  { benchmark(b, true, 20480) }
+func BenchmarkGzipHandler_P100k(b *testing.B) { benchmark(b, true, 102400) }
+
+func BenchmarkHandlerAllocs_Gzip(b *testing.B)  { benchmarkAllocs(b, 20480, "application/json") }
+func BenchmarkHandlerAllocs_Plain(b *testing.B) { benchmarkAllocs(b, 100, "application/json") }
+func BenchmarkHandlerAllocs_GzipCharset(b *testing.B) {
+	benchmarkAllocs(b, 20480, "application/json; charset=utf-8")
+}
+func BenchmarkHandlerAllocs_PlainCharset(b *testing.B) {
+	benchmarkAllocs(b, 100, "application/json; charset=utf-8")
+}
+
+// --------------------------------------------------------------------
+
+func gzipStrLevel(s string, lvl int) []byte {
+	var b bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&b, lvl)
+	io.WriteString(w, s)
+	w.Close()
+	return b.Bytes()
+}
+
+// readPartialGzip decompresses the first n bytes of a gzip stream that
+// hasn't been closed yet.
+func readPartialGzip(t *testing.T, b []byte, n int) string {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	require.Nil(t, err)
+	buf := make([]byte, n)
+	_, err = io.ReadFull(zr, buf)
+	require.Nil(t, err)
+	return string(buf)
+}
+
+// gunzip decompresses the whole gzip stream.
+func gunzip(t *testing.T, b []byte) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	require.Nil(t, err)
+	out, err := io.ReadAll(zr)
+	require.Nil(t, err)
+	return out
+}
+
+func benchmark(b *testing.B, parallel bool, size int) {
+	bin, err := ioutil.ReadFile("testdata/benchmark.json")
+	if err != nil {
+		b.Fatal(err)
+	}
 
 	req, _ := http.NewRequest("GET", "/whatever", nil)
 	req.Header.Set("Accept-Encoding", "gzip")
@@ -644,6 +2280,46 @@ func benchmark(b *testing.B, parallel bool, size int) {
 	}
 }
 
+// benchmarkAllocs measures the allocations of Config.Handler in the steady
+// state. The handler and the ResponseWriter don't allocate themselves.
+func benchmarkAllocs(b *testing.B, size int, contentType string) {
+	bin, err := os.ReadFile("testdata/benchmark.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := bin[:size]
+	ct := []string{contentType}
+
+	c, err := New(PoolResponseWriters(true))
+	if err != nil {
+		b.Fatal(err)
+	}
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = ct
+		w.Write(body)
+	}))
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := &discardResponseWriter{header: make(http.Header)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clear(w.header)
+		handler.ServeHTTP(w, req)
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that doesn't allocate.
+type discardResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(code int)        { w.code = code }
+
 func runBenchmark(b *testing.B, req *http.Request, handler http.Handler) {
 	res := httptest.NewRecorder()
 	handler.ServeHTTP(res, req)
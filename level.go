@@ -0,0 +1,190 @@
+package httpgzip
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+const (
+	minLevel  = gzip.StatelessCompression
+	numLevels = gzip.BestCompression - minLevel + 1
+
+	// SkipCompression can be returned by a LevelFunc to serve the response
+	// uncompressed.
+	SkipCompression = -100
+
+	// defaultLevel is what gzip.DefaultCompression stands for in
+	// klauspost/compress.
+	defaultLevel = 5
+)
+
+// LevelFunc chooses the compression level of a response, which is served
+// uncompressed if SkipCompression is returned. The request is nil for
+// writers created with Config.ResponseWriter.
+type LevelFunc func(r *http.Request, hint LevelHint) int
+
+// LevelHint describes the response a LevelFunc chooses the level for.
+type LevelHint struct {
+	// ContentType is the content type of the response.
+	ContentType string
+	// Size is the Content-Length of the response, if known, or the size of
+	// its beginning that has been written so far.
+	Size int
+	// Level is the level that would be used otherwise.
+	Level int
+}
+
+// DeadlinePolicy returns a LevelFunc that uses gzip.BestSpeed when less
+// than the given time remains until the deadline of the request context,
+// since a better compression ratio is not worth missing the deadline.
+func DeadlinePolicy(threshold time.Duration) LevelFunc {
+	return func(r *http.Request, hint LevelHint) int {
+		if r == nil {
+			return hint.Level
+		}
+		if deadline, ok := r.Context().Deadline(); ok && time.Until(deadline) < threshold {
+			return gzip.BestSpeed
+		}
+		return hint.Level
+	}
+}
+
+func validLevel(level int) bool {
+	return level == gzip.DefaultCompression ||
+		level == gzip.HuffmanOnly ||
+		level == gzip.StatelessCompression ||
+		(level >= gzip.BestSpeed && level <= gzip.BestCompression)
+}
+
+// levelHint describes the response for acquireLevel.
+func (w *gzipResponseWriter) levelHint() LevelHint {
+	size := parseContentLength(w.Header())
+	if size == 0 {
+		size = len(w.buf)
+	}
+	return LevelHint{
+		ContentType: w.Header().Get(contentType),
+		Size:        size,
+	}
+}
+
+// getWriter returns a gzip writer with the compression level from the
+// encoder pool.
+func (c *Config) getWriter(level int) *gzip.Writer {
+	gw, allocated := c.encoders.get(level)
+	if po, ok := c.observer.(PoolObserver); ok {
+		po.PoolGet(level, allocated)
+	}
+	return gw
+}
+
+func (c *Config) putWriter(gw *gzip.Writer, level int) {
+	c.encoders.put(gw, level)
+}
+
+// acquireLevel returns the compression level for a new compressed response,
+// given the ContentTypeRule matching it, if any,
+// or the reason why the response should be served as-is. The caller must
+// call releaseLevel once the compressed response is done.
+func (c *Config) acquireLevel(r *http.Request, hint LevelHint, rule *contentTypeRule) (int, SkipReason) {
+	if c.sem != nil && !c.acquireSlot() {
+		c.rejected.Add(1)
+		return 0, ReasonOverload
+	}
+	n := int(c.inflight.Add(1)) - 1
+
+	level := c.level
+	if rule != nil && rule.level != 0 {
+		level = rule.level
+	}
+	if c.adaptiveInFlight > 0 {
+		var ok bool
+		if level, ok = adaptLevel(level, n, c.adaptiveInFlight); !ok {
+			c.releaseLevel()
+			return 0, ReasonOverload
+		}
+	}
+
+	if c.statelessInFlight > 0 && n >= c.statelessInFlight {
+		level = gzip.StatelessCompression
+	}
+
+	if c.levelFunc != nil {
+		hint.Level = level
+		level = c.levelFunc(r, hint)
+		if level == SkipCompression {
+			c.releaseLevel()
+			return 0, ReasonPolicy
+		}
+		if !validLevel(level) {
+			level = hint.Level
+		}
+	}
+	return level, ReasonNone
+}
+
+func (c *Config) releaseLevel() {
+	c.inflight.Add(-1)
+	if c.sem != nil {
+		<-c.sem
+	}
+}
+
+// acquireSlot takes one of the MaxInFlight slots, waiting for it up to the
+// configured timeout.
+func (c *Config) acquireSlot() bool {
+	select {
+	case c.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if c.semWait <= 0 {
+		return false
+	}
+
+	t := time.NewTimer(c.semWait)
+	defer t.Stop()
+	select {
+	case c.sem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Stats are the gauges of a Config.
+type Stats struct {
+	// InFlight is the number of responses being compressed.
+	InFlight int64
+	// Rejected is the number of responses served uncompressed because
+	// of MaxInFlight.
+	Rejected uint64
+}
+
+// Stats returns the current gauges.
+func (c *Config) Stats() Stats {
+	return Stats{
+		InFlight: c.inflight.Load(),
+		Rejected: c.rejected.Load(),
+	}
+}
+
+// adaptLevel lowers the level according to the number of responses already
+// being compressed.
+func adaptLevel(level, inflight, max int) (int, bool) {
+	if inflight >= 2*max {
+		return 0, false
+	}
+	if level == gzip.DefaultCompression {
+		level = defaultLevel
+	}
+	if level <= gzip.BestSpeed {
+		return level, true
+	}
+	if inflight >= max {
+		return gzip.BestSpeed, true
+	}
+	return level - (level-gzip.BestSpeed)*inflight/max, true
+}
@@ -0,0 +1,58 @@
+package httpgzip
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorHandler is called with the failures of writing, flushing and
+// closing responses that would otherwise go unnoticed. Op is "write",
+// "flush" or "close". The request is nil for writers created with
+// Config.ResponseWriter.
+type ErrorHandler func(r *http.Request, op string, err error)
+
+// failed reports the failure of the operation to the error handler and the
+// logger.
+func (c *Config) failed(r *http.Request, op string, err error) {
+	if c.onError != nil {
+		c.onError(r, op, err)
+	}
+	if c.logger != nil {
+		c.logger.LogAttrs(requestContext(r), slog.LevelError, "httpgzip: "+op+" failed",
+			append(requestAttrs(r), slog.Any("error", err))...)
+	}
+}
+
+// logDecision logs the decision at the debug level.
+func (c *Config) logDecision(r *http.Request, d Decision) {
+	ctx := requestContext(r)
+	if c.logger == nil || !c.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := append(requestAttrs(r), slog.Bool("compressed", d.Compressed))
+	if d.Compressed {
+		attrs = append(attrs, slog.Int("level", d.Level))
+	} else {
+		attrs = append(attrs, slog.String("reason", d.Reason.String()))
+	}
+	c.logger.LogAttrs(ctx, slog.LevelDebug, "httpgzip: decided", attrs...)
+}
+
+func requestContext(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
+
+func requestAttrs(r *http.Request) []slog.Attr {
+	if r == nil {
+		return nil
+	}
+	return []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("remote_addr", r.RemoteAddr),
+	}
+}
@@ -0,0 +1,248 @@
+// Package metrics collects metrics about compressed responses and exposes
+// them in the Prometheus text exposition format.
+//
+//	m := metrics.New()
+//	c, _ := httpgzip.New(httpgzip.Observe(m))
+//	http.Handle("/metrics", m)
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/vmihailenco/httpgzip"
+)
+
+// DefaultRatioBuckets are the buckets of the compression ratio histogram.
+var DefaultRatioBuckets = []float64{1, 2, 3, 4, 5, 7.5, 10, 15, 20}
+
+// DefaultDurationBuckets are the buckets of the compression latency
+// histogram, in seconds.
+var DefaultDurationBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Collector is an httpgzip.Observer that maintains counters and histograms
+// of compressed responses. It is an http.Handler that renders them in the
+// Prometheus text exposition format.
+type Collector struct {
+	mu        sync.Mutex
+	decisions map[decisionKey]uint64
+	responses map[string]uint64
+	bytesIn   map[string]uint64
+	bytesOut  map[string]uint64
+	ratio     histogram
+	duration  histogram
+	poolGets  map[int]uint64
+	poolNews  map[int]uint64
+}
+
+type decisionKey struct {
+	outcome string
+	reason  string
+}
+
+var (
+	_ httpgzip.Observer     = (*Collector)(nil)
+	_ httpgzip.PoolObserver = (*Collector)(nil)
+	_ http.Handler          = (*Collector)(nil)
+)
+
+// New returns a Collector with the default buckets.
+func New() *Collector {
+	return &Collector{
+		decisions: make(map[decisionKey]uint64),
+		responses: make(map[string]uint64),
+		bytesIn:   make(map[string]uint64),
+		bytesOut:  make(map[string]uint64),
+		ratio:     newHistogram(DefaultRatioBuckets),
+		duration:  newHistogram(DefaultDurationBuckets),
+		poolGets:  make(map[int]uint64),
+		poolNews:  make(map[int]uint64),
+	}
+}
+
+// Decided implements httpgzip.Observer.
+func (c *Collector) Decided(_ *http.Request, d httpgzip.Decision) {
+	k := decisionKey{outcome: "compressed", reason: d.Reason.String()}
+	if !d.Compressed {
+		k.outcome = "skipped"
+	}
+	c.mu.Lock()
+	c.decisions[k]++
+	c.mu.Unlock()
+}
+
+// Completed implements httpgzip.Observer.
+func (c *Collector) Completed(_ *http.Request, res httpgzip.Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses[res.Coding]++
+	c.bytesIn[res.Coding] += uint64(res.BytesIn)
+	c.bytesOut[res.Coding] += uint64(res.BytesOut)
+	if res.Coding != "gzip" {
+		return
+	}
+	if res.BytesOut > 0 {
+		c.ratio.observe(float64(res.BytesIn) / float64(res.BytesOut))
+	}
+	c.duration.observe(res.Duration.Seconds())
+}
+
+// PoolGet implements httpgzip.PoolObserver.
+func (c *Collector) PoolGet(level int, allocated bool) {
+	c.mu.Lock()
+	c.poolGets[level]++
+	if allocated {
+		c.poolNews[level]++
+	}
+	c.mu.Unlock()
+}
+
+// ServeHTTP renders the metrics in the Prometheus text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	_, _ = c.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	c.mu.Lock()
+	c.write(cw)
+	c.mu.Unlock()
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+func (c *Collector) write(w *countWriter) {
+	w.header("httpgzip_decisions_total", "counter",
+		"Compression decisions by outcome and skip reason.")
+	keys := make([]decisionKey, 0, len(c.decisions))
+	for k := range c.decisions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].outcome != keys[j].outcome {
+			return keys[i].outcome < keys[j].outcome
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	for _, k := range keys {
+		w.sample("httpgzip_decisions_total",
+			`outcome="`+k.outcome+`",reason="`+k.reason+`"`, formatUint(c.decisions[k]))
+	}
+
+	w.codingCounter("httpgzip_responses_total", "Completed responses by content coding.", c.responses)
+	w.codingCounter("httpgzip_bytes_in_total", "Bytes written by handlers by content coding.", c.bytesIn)
+	w.codingCounter("httpgzip_bytes_out_total", "Bytes written to clients by content coding.", c.bytesOut)
+
+	w.histogram("httpgzip_compression_ratio",
+		"Ratio of uncompressed to compressed size of gzip responses.", &c.ratio)
+	w.histogram("httpgzip_compression_duration_seconds",
+		"Time spent compressing gzip responses.", &c.duration)
+
+	w.levelCounter("httpgzip_pool_gets_total", "Gzip writers taken from the pool by level.", c.poolGets)
+	w.levelCounter("httpgzip_pool_news_total", "Gzip writers allocated by level.", c.poolNews)
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // non-cumulative, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countWriter) str(s string) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.WriteString(s)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *countWriter) header(name, typ, help string) {
+	w.str("# HELP " + name + " " + help + "\n")
+	w.str("# TYPE " + name + " " + typ + "\n")
+}
+
+func (w *countWriter) sample(name, labels, value string) {
+	w.str(name)
+	if labels != "" {
+		w.str("{" + labels + "}")
+	}
+	w.str(" " + value + "\n")
+}
+
+func (w *countWriter) codingCounter(name, help string, m map[string]uint64) {
+	w.header(name, "counter", help)
+	codings := make([]string, 0, len(m))
+	for coding := range m {
+		codings = append(codings, coding)
+	}
+	sort.Strings(codings)
+	for _, coding := range codings {
+		w.sample(name, `coding="`+coding+`"`, formatUint(m[coding]))
+	}
+}
+
+func (w *countWriter) levelCounter(name, help string, m map[int]uint64) {
+	w.header(name, "counter", help)
+	levels := make([]int, 0, len(m))
+	for level := range m {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+	for _, level := range levels {
+		w.sample(name, `level="`+strconv.Itoa(level)+`"`, formatUint(m[level]))
+	}
+}
+
+func (w *countWriter) histogram(name, help string, h *histogram) {
+	w.header(name, "histogram", help)
+	var cum uint64
+	for i, bound := range h.bounds {
+		cum += h.counts[i]
+		w.sample(name+"_bucket", `le="`+formatFloat(bound)+`"`, formatUint(cum))
+	}
+	w.sample(name+"_bucket", `le="+Inf"`, formatUint(h.count))
+	w.sample(name+"_sum", "", formatFloat(h.sum))
+	w.sample(name+"_count", "", formatUint(h.count))
+}
+
+func formatUint(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,54 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/vmihailenco/httpgzip"
+	"github.com/vmihailenco/httpgzip/metrics"
+)
+
+func TestCollector(t *testing.T) {
+	m := metrics.New()
+	c, err := httpgzip.New(httpgzip.Observe(m), httpgzip.MinSize(10))
+	require.NoError(t, err)
+
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+	for _, body := range []string{strings.Repeat("a", 1000), strings.Repeat("b", 1000), "c"} {
+		req := httptest.NewRequest(http.MethodGet, "/?body="+body, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", res.Header().Get("Content-Type"))
+
+	out := res.Body.String()
+	for _, line := range []string{
+		"# TYPE httpgzip_decisions_total counter",
+		`httpgzip_decisions_total{outcome="compressed",reason="none"} 2`,
+		`httpgzip_decisions_total{outcome="skipped",reason="too-small"} 1`,
+		`httpgzip_responses_total{coding="gzip"} 2`,
+		`httpgzip_responses_total{coding="identity"} 1`,
+		`httpgzip_bytes_in_total{coding="gzip"} 2000`,
+		`httpgzip_bytes_out_total{coding="identity"} 1`,
+		"# TYPE httpgzip_compression_ratio histogram",
+		`httpgzip_compression_ratio_bucket{le="1"} 0`,
+		`httpgzip_compression_ratio_bucket{le="+Inf"} 2`,
+		"httpgzip_compression_ratio_count 2",
+		`httpgzip_compression_duration_seconds_bucket{le="+Inf"} 2`,
+		"httpgzip_compression_duration_seconds_count 2",
+		`httpgzip_pool_gets_total{level="-1"} 2`,
+		`httpgzip_pool_news_total{level="-1"} `,
+	} {
+		require.Contains(t, out, line)
+	}
+}
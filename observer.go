@@ -0,0 +1,139 @@
+package httpgzip
+
+import (
+	"net/http"
+	"time"
+)
+
+// Observer is notified about the compression of responses, e.g. to collect
+// metrics. It is called concurrently for different responses.
+type Observer interface {
+	// Decided is called once it is decided whether to compress the
+	// response. The request is nil for writers created with
+	// Config.ResponseWriter.
+	Decided(r *http.Request, d Decision)
+	// Completed is called when the response is closed. It is not called
+	// for requests that don't accept gzip, see ReasonNoAccept.
+	Completed(r *http.Request, res Result)
+}
+
+// PoolObserver can be implemented by an Observer to be notified about the
+// pools of gzip writers.
+type PoolObserver interface {
+	// PoolGet is called when a gzip writer with the compression level is
+	// taken from the pool. Allocated tells whether the pool was empty, so
+	// a new writer was allocated.
+	PoolGet(level int, allocated bool)
+}
+
+// Decision describes whether a response is compressed.
+type Decision struct {
+	// Compressed tells whether the response is compressed.
+	Compressed bool
+	// Reason is why the response is not compressed.
+	Reason SkipReason
+	// Level is the compression level of a compressed response.
+	Level int
+}
+
+// Result describes a completed response.
+type Result struct {
+	// Coding is the content coding applied by the writer, "gzip" or
+	// "identity".
+	Coding string
+	// StatusCode is the status code of the response.
+	StatusCode int
+	// BytesIn is the number of bytes written by the handler.
+	BytesIn int64
+	// BytesOut is the number of bytes written to the client.
+	BytesOut int64
+	// Duration is the time spent compressing.
+	Duration time.Duration
+}
+
+// SkipReason is why a response is not compressed.
+type SkipReason int
+
+const (
+	// ReasonNone means that the response is compressed.
+	ReasonNone SkipReason = iota
+	// ReasonNoAccept means that the request doesn't accept gzip.
+	ReasonNoAccept
+	// ReasonAlreadyEncoded means that the handler set a Content-Encoding.
+	ReasonAlreadyEncoded
+	// ReasonContentType means that the content type is not one of
+	// ContentTypes.
+	ReasonContentType
+	// ReasonTooSmall means that the response is smaller than the minimum
+	// size.
+	ReasonTooSmall
+	// ReasonCrossSite means that the request is cross-site, see
+	// SkipCrossSite.
+	ReasonCrossSite
+	// ReasonSecret means that the response was passed to MarkSecret.
+	ReasonSecret
+	// ReasonOverload means that too many responses are being compressed,
+	// see AdaptiveLevel and MaxInFlight.
+	ReasonOverload
+	// ReasonPolicy means that the LevelFunc returned SkipCompression.
+	ReasonPolicy
+	// ReasonNoBody means that the status code doesn't allow a body, i.e. 204
+	// or 304.
+	ReasonNoBody
+)
+
+var skipReasons = [...]string{
+	ReasonNone:           "none",
+	ReasonNoAccept:       "no-accept",
+	ReasonAlreadyEncoded: "already-encoded",
+	ReasonContentType:    "content-type",
+	ReasonTooSmall:       "too-small",
+	ReasonCrossSite:      "cross-site",
+	ReasonSecret:         "secret",
+	ReasonOverload:       "overload",
+	ReasonPolicy:         "policy",
+	ReasonNoBody:         "no-body",
+}
+
+func (r SkipReason) String() string {
+	if r >= 0 && int(r) < len(skipReasons) {
+		return skipReasons[r]
+	}
+	return "unknown"
+}
+
+// decided notifies the observer about the decision.
+func (w *gzipResponseWriter) decided() {
+	if w.cfg.observer == nil && w.cfg.logger == nil {
+		return
+	}
+	d := Decision{Compressed: w.compress, Reason: w.reason}
+	if w.compress {
+		d.Level = w.level
+	}
+	if w.cfg.observer != nil {
+		w.cfg.observer.Decided(w.req, d)
+	}
+	w.cfg.logDecision(w.req, d)
+}
+
+// completed notifies the observer about the result.
+func (w *gzipResponseWriter) completed() {
+	if w.cfg.observer == nil {
+		return
+	}
+	res := Result{
+		Coding:     "identity",
+		StatusCode: w.status,
+		BytesIn:    w.bytesIn,
+		BytesOut:   w.bytesOut,
+		Duration:   w.dur,
+	}
+	if w.compress {
+		res.Coding = "gzip"
+	}
+	if res.StatusCode == 0 {
+		res.StatusCode = http.StatusOK
+	}
+	w.cfg.observer.Completed(w.req, res)
+}
@@ -0,0 +1,158 @@
+package httpgzip
+
+import (
+	"bytes"
+	"io"
+)
+
+// defaultBlockSize is the block size of ParallelCompression.
+const defaultBlockSize = 1 << 20
+
+// parallelWriter compresses blocks of the response concurrently, each one
+// into a gzip member of its own, and writes them out in order. Concatenated
+// gzip members are a valid gzip stream.
+type parallelWriter struct {
+	w *gzipResponseWriter
+	// Block being filled.
+	cur *block
+	// Blocks being compressed in the order of the response.
+	pending []*block
+	// Blocks that have been written out, for reuse.
+	free []*block
+}
+
+type block struct {
+	in   []byte
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// writeParallel writes to the gzip writer until the response reaches the
+// parallel compression threshold and to the parallelWriter afterwards.
+func (w *gzipResponseWriter) writeParallel(b []byte) (int, error) {
+	var n int
+	if w.par == nil {
+		if room := int64(w.cfg.parallelThreshold) - w.bytesIn; room > 0 {
+			if int64(len(b)) <= room {
+				return w.gw.Write(b)
+			}
+			m, err := w.gw.Write(b[:room])
+			n += m
+			if err != nil {
+				return n, err
+			}
+			b = b[room:]
+		}
+		// The first member ends at the threshold. The closed gzip writer
+		// is put back into the pool by closeGzip as usual.
+		if err := w.gw.Close(); err != nil {
+			return n, err
+		}
+		w.par = &parallelWriter{w: w}
+	}
+	m, err := w.par.Write(b)
+	return n + m, err
+}
+
+func (p *parallelWriter) Write(b []byte) (int, error) {
+	blockSize := p.w.cfg.blockSize
+	var n int
+	for len(b) > 0 {
+		if p.cur == nil {
+			p.cur = p.newBlock()
+		}
+		m := min(blockSize-len(p.cur.in), len(b))
+		p.cur.in = append(p.cur.in, b[:m]...)
+		b = b[m:]
+		n += m
+		if len(p.cur.in) == blockSize {
+			if err := p.submit(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush compresses the partial block and writes out all the blocks.
+func (p *parallelWriter) Flush() error {
+	if p.cur != nil && len(p.cur.in) > 0 {
+		if err := p.submit(); err != nil {
+			return err
+		}
+	}
+	for len(p.pending) > 0 {
+		if err := p.writeOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is Flush, since every block is a complete gzip member.
+func (p *parallelWriter) Close() error {
+	return p.Flush()
+}
+
+// submit starts compressing the current block. Once the configured number of
+// blocks is being compressed, it waits for the oldest one, which holds back
+// the handler when the workers can't keep up.
+func (p *parallelWriter) submit() error {
+	for len(p.pending) >= p.w.cfg.workers {
+		if err := p.writeOldest(); err != nil {
+			return err
+		}
+	}
+
+	blk := p.cur
+	p.cur = nil
+	p.pending = append(p.pending, blk)
+
+	cfg, level := p.w.cfg, p.w.level
+	go func() {
+		defer close(blk.done)
+		gw := cfg.getWriter(level)
+		gw.Reset(&blk.out)
+		if _, err := gw.Write(blk.in); err != nil {
+			blk.err = err
+		} else {
+			blk.err = gw.Close()
+		}
+		cfg.putWriter(gw, level)
+	}()
+	return nil
+}
+
+// writeOldest waits for the oldest block to be compressed and writes it out.
+func (p *parallelWriter) writeOldest() error {
+	blk := p.pending[0]
+	<-blk.done
+	p.pending = p.pending[1:]
+
+	if blk.err != nil {
+		return blk.err
+	}
+	out := blk.out.Bytes()
+	n, err := gzipOutput{p.w}.Write(out)
+	if err == nil && n < len(out) {
+		err = io.ErrShortWrite
+	}
+	p.free = append(p.free, blk)
+	return err
+}
+
+func (p *parallelWriter) newBlock() *block {
+	if n := len(p.free); n > 0 {
+		blk := p.free[n-1]
+		p.free = p.free[:n-1]
+		blk.in = blk.in[:0]
+		blk.out.Reset()
+		blk.done = make(chan struct{})
+		return blk
+	}
+	return &block{
+		in:   make([]byte, 0, p.w.cfg.blockSize),
+		done: make(chan struct{}),
+	}
+}
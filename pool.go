@@ -0,0 +1,123 @@
+package httpgzip
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// EncoderPool is a pool of gzip writers by compression level. Each Config
+// has its own pool unless one is shared by several Configs with
+// SharedEncoderPool, which saves memory since gzip writers take up to
+// ~800KB at high compression levels.
+type EncoderPool struct {
+	maxIdle int
+	levels  [numLevels]encoderLevel
+
+	allocs atomic.Uint64
+	reuses atomic.Uint64
+}
+
+type encoderLevel struct {
+	// Unbounded pool, which is emptied by the garbage collector.
+	pool sync.Pool
+	// Bounded pool of MaxIdle writers.
+	idle chan *gzip.Writer
+}
+
+// EncoderPoolStats are statistics of an EncoderPool.
+type EncoderPoolStats struct {
+	// Allocs is the number of gzip writers allocated, including their
+	// compressors.
+	Allocs uint64
+	// Reuses is the number of gzip writers taken from the pool.
+	Reuses uint64
+	// Idle is the number of gzip writers in a pool with maxIdle.
+	Idle int
+}
+
+// NewEncoderPool returns a pool that keeps up to maxIdle idle gzip writers
+// per compression level. If maxIdle is 0, then the number of idle writers is
+// not limited but they are freed by the garbage collector.
+func NewEncoderPool(maxIdle int) *EncoderPool {
+	p := &EncoderPool{maxIdle: maxIdle}
+	if maxIdle > 0 {
+		for i := range p.levels {
+			p.levels[i].idle = make(chan *gzip.Writer, maxIdle)
+		}
+	}
+	return p
+}
+
+// Prewarm allocates n gzip writers with the compression level and puts them
+// into the pool, so they don't need to be allocated when the first
+// responses are compressed.
+func (p *EncoderPool) Prewarm(level, n int) error {
+	if !validLevel(level) {
+		return fmt.Errorf("invalid compression level requested: %d", level)
+	}
+	for i := 0; i < n; i++ {
+		p.put(p.newWriter(level), level)
+	}
+	return nil
+}
+
+// newWriter allocates a gzip writer with the compression level. The gzip
+// writer only allocates its compressor, which takes most of its memory, on
+// the first write, so it is closed once to allocate it up front.
+func (p *EncoderPool) newWriter(level int) *gzip.Writer {
+	gw, _ := gzip.NewWriterLevel(io.Discard, level)
+	gw.Close()
+	p.allocs.Add(1)
+	return gw
+}
+
+// Stats returns the statistics of the pool.
+func (p *EncoderPool) Stats() EncoderPoolStats {
+	var idle int
+	for i := range p.levels {
+		idle += len(p.levels[i].idle)
+	}
+	return EncoderPoolStats{
+		Allocs: p.allocs.Load(),
+		Reuses: p.reuses.Load(),
+		Idle:   idle,
+	}
+}
+
+// get returns a pooled gzip writer with the compression level or allocates
+// a new one, in which case allocated is true.
+func (p *EncoderPool) get(level int) (gw *gzip.Writer, allocated bool) {
+	l := &p.levels[level-minLevel]
+	if l.idle != nil {
+		select {
+		case gw = <-l.idle:
+		default:
+		}
+	} else {
+		gw, _ = l.pool.Get().(*gzip.Writer)
+	}
+
+	if gw == nil {
+		return p.newWriter(level), true
+	}
+	p.reuses.Add(1)
+	return gw, false
+}
+
+// put puts the gzip writer back into the pool unless there are already
+// maxIdle idle writers.
+func (p *EncoderPool) put(gw *gzip.Writer, level int) {
+	l := &p.levels[level-minLevel]
+	if l.idle == nil {
+		l.pool.Put(gw)
+		return
+	}
+	select {
+	case l.idle <- gw:
+	default:
+	}
+}
@@ -2,11 +2,20 @@ package httpgzip
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/klauspost/compress/gzip"
 )
@@ -25,100 +34,482 @@ type gzipResponseWriter struct {
 
 	cfg *Config
 	gw  *gzip.Writer
+	// Compresses the response past the first gzip member, see
+	// ParallelCompression.
+	par *parallelWriter
+	// Compresses the response in the background, see AsyncCompression.
+	async *asyncWriter
+	// The request being served or nil if unknown.
+	req *http.Request
+	// Compression level of the gzip writer.
+	level int
+	// Span of the response, see Trace.
+	span Span
+	// Whether to add the Server-Timing and debug headers, see ServerTiming
+	// and DebugHeaders.
+	timing bool
+	debug  bool
 
 	// Saves the WriteHeader value.
 	code int
+	// The final status code of the response.
+	status int
+	// Why the response is not compressed.
+	reason SkipReason
+
+	// The Content-Type header value that ct was parsed from, see mediaType.
+	ctHeader string
+	ctParsed bool
+	// The parsed Content-Type or nil if it is invalid.
+	ct *parsedContentType
+	// Backing struct of ct, which saves an allocation.
+	pct parsedContentType
 
 	// Holds the first part of the write before reaching the minSize or the end of the write.
 	buf []byte
+	// Backing array of buf, which is kept when the writer is pooled.
+	spare []byte
 	// If true, then we immediately passthru writes to the underlying ResponseWriter.
 	ignore bool
+	// If true, then writes are compressed. The gzip writer itself is only
+	// initialized on the first non-empty write.
+	compress bool
+
+	// If true, then the response contains secrets and must not be compressed.
+	secret bool
+
+	// Writes collected for the levels without history, see writeBlock.
+	block []byte
+
+	// Event delimiter of a streaming response that triggers a flush.
+	delim []byte
+	// The last byte written, since event delimiters can be split across
+	// writes.
+	last byte
+
+	// Number of bytes written by the handler and the CRC-32 of those that
+	// were compressed.
+	bytesIn int64
+	crc     uint32
+	// Number of bytes written to the underlying ResponseWriter.
+	bytesOut int64
+	// Time spent compressing, if measured.
+	dur time.Duration
+	// Hashes of the compressed bytes for the Content-Digest.
+	digests []hash.Hash
+
+	// If true, then the compressed response is held in out until it either
+	// completes or outgrows the configured buffer size.
+	buffering bool
+	out       []byte
+	closed    bool
+	// If true, then a failed write has been reported.
+	writeErr bool
+	// If true, then the rest of the response is discarded, see abort and
+	// disconnected.
+	discarded bool
+
+	// Guards the writer against the idle flush timer.
+	mu sync.Mutex
+	// Flushes written data if the handler doesn't write for a while.
+	timer *time.Timer
+	// If true, then there is written data that hasn't been flushed.
+	pending bool
+	// Stops discarding the response once the request is done, see
+	// StopOnDisconnect. It is kept if the discarding has already begun.
+	stopDisconnect func() bool
 }
 
 var _ ResponseWriter = (*gzipResponseWriter)(nil)
 
-type gzipResponseWriterWithCloseNotify struct {
-	*gzipResponseWriter
-}
+// maxSpareSize is the largest buffer kept by a pooled writer.
+const maxSpareSize = 64 << 10
 
-func (w gzipResponseWriterWithCloseNotify) CloseNotify() <-chan bool {
-	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
-}
+// ErrDisconnected is returned by writes of compressed responses after the
+// client disconnected, see StopOnDisconnect.
+var ErrDisconnected = errors.New("httpgzip: client disconnected")
 
 // Write appends data to the gzip writer.
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.write(b)
+	if err != nil {
+		w.writeFailed(err)
+	}
+	return n, err
+}
+
+// writeFailed reports the first failed write of the response, since the
+// following ones usually fail for the same reason.
+func (w *gzipResponseWriter) writeFailed(err error) {
+	if !w.writeErr {
+		w.writeErr = true
+		w.cfg.failed(w.req, "write", err)
+	}
+}
+
+func (w *gzipResponseWriter) write(b []byte) (int, error) {
 	// GZIP responseWriter is initialized. Use the GZIP responseWriter.
-	if w.gw != nil {
-		return w.gw.Write(b)
+	if w.compress {
+		return w.writeGzip(b)
 	}
 
 	// If we have already decided not to use GZIP, immediately passthrough.
 	if w.ignore {
-		return w.ResponseWriter.Write(b)
+		return w.writePlain(b)
+	}
+
+	// The headers alone may already be conclusive, in which case there is no
+	// point in buffering the write.
+	if len(w.buf) == 0 {
+		if err := w.start(w.decide(false, false)); err != nil {
+			return 0, err
+		}
+		if w.compress || w.ignore {
+			return w.write(b)
+		}
 	}
 
 	// Save the write into a buffer for later use in GZIP responseWriter (if content is long enough) or at close with regular responseWriter.
 	// On the first write, w.buf changes from nil to a valid slice
+	if w.buf == nil && len(b) > 0 {
+		if w.spare == nil {
+			w.spare = make([]byte, 0, max(min(w.cfg.minSize, maxSpareSize), len(b)))
+		}
+		w.buf = w.spare[:0]
+	}
 	w.buf = append(w.buf, b...)
+	if cap(w.buf) > cap(w.spare) {
+		w.spare = w.buf
+	}
+
+	if err := w.start(w.decide(true, false)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *gzipResponseWriter) writeGzip(b []byte) (int, error) {
+	if w.disconnected() {
+		return 0, w.cfg.disconnectErr
+	}
+	if w.gw == nil {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		w.init()
+	}
+	start := w.startTimer()
+	var n int
+	var err error
+	if w.block != nil {
+		n, err = w.writeBlock(b)
+	} else {
+		n, err = w.compressBytes(b)
+	}
+	w.stopTimer(start)
+	w.bytesIn += int64(n)
+	if w.cfg.uncompressedTrailers {
+		w.crc = crc32.Update(w.crc, crc32.IEEETable, b[:n])
+	}
+	if err == nil && w.delim != nil && w.endsEvent(b) {
+		err = w.flushQuietly()
+	} else if err == nil && w.cfg.flushLatency > 0 {
+		w.scheduleFlush()
+	}
+	return n, err
+}
+
+// compressBytes writes b to the gzip writer.
+func (w *gzipResponseWriter) compressBytes(b []byte) (int, error) {
+	if w.async != nil {
+		return w.async.Write(b)
+	}
+	if w.cfg.parallelThreshold > 0 {
+		return w.writeParallel(b)
+	}
+	return w.gw.Write(b)
+}
+
+// minBlockSize is the smallest block compressed at the levels without
+// history, see writeBlock.
+const minBlockSize = 32 << 10
 
+// writeBlock collects writes into blocks of at least minBlockSize for the
+// StatelessCompression and HuffmanOnly levels, which have no history to
+// compress a small write against. StatelessCompression even compresses every
+// write on its own, so responses made of small writes would end up larger
+// than uncompressed.
+func (w *gzipResponseWriter) writeBlock(b []byte) (int, error) {
+	if len(w.block) == 0 && len(b) >= minBlockSize {
+		return w.compressBytes(b)
+	}
+	w.block = append(w.block, b...)
+	if len(w.block) >= minBlockSize {
+		return len(b), w.writeOutBlock()
+	}
+	return len(b), nil
+}
+
+// writeOutBlock compresses the block collected by writeBlock, if any.
+func (w *gzipResponseWriter) writeOutBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	_, err := w.compressBytes(w.block)
+	w.block = w.block[:0]
+	return err
+}
+
+type decision int
+
+const (
+	decisionWait decision = iota
+	decisionGzip
+	decisionPlain
+)
+
+// decide reports whether the response should be compressed given the headers
+// set so far and the buffered part of the body. The content type is sniffed
+// from the buffer only when sniff is set, and final means that the whole body
+// has been buffered so waiting for more data is not an option.
+func (w *gzipResponseWriter) decide(sniff, final bool) decision {
 	var (
-		cl, _ = strconv.Atoi(w.Header().Get(contentLength))
-		ct    = w.Header().Get(contentType)
-		ce    = w.Header().Get(contentEncoding)
+		cl = parseContentLength(w.Header())
+		ct = w.Header().Get(contentType)
+		ce = w.Header().Get(contentEncoding)
 	)
-	// Only continue if they didn't already choose an encoding or a known unhandled content length or type.
-	if ce == "" && (cl == 0 || cl >= w.cfg.minSize) && (ct == "" || handleContentType(w.cfg.contentTypes, ct)) {
+	// Responses without a body are left alone.
+	if w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		w.reason = ReasonNoBody
+		return decisionPlain
+	}
+	// Don't continue if they already chose an encoding or a known unhandled content length or type.
+	if ce != "" {
+		w.reason = ReasonAlreadyEncoded
+		return decisionPlain
+	}
+	if w.secret {
+		w.reason = ReasonSecret
+		return decisionPlain
+	}
+	minSize := w.cfg.minSize
+	if ct != "" {
+		pct := w.mediaType()
+		if !handleContentType(w.cfg.contentTypes, pct) {
+			w.reason = ReasonContentType
+			return decisionPlain
+		}
+		// Streams are compressed right away since waiting for minSize bytes
+		// would hold back early events.
+		if w.cfg.streamDelimiter(pct) != nil {
+			return decisionGzip
+		}
+		if rule := w.cfg.rule(pct); rule != nil && rule.minSize != 0 {
+			minSize = max(rule.minSize, 0)
+		}
+	}
+
+	if final {
+		if len(w.buf) == 0 {
+			w.reason = ReasonTooSmall
+			return decisionPlain
+		}
+		cl = len(w.buf)
+	}
+	if cl == 0 {
 		// If the current buffer is less than minSize and a Content-Length isn't set, then wait until we have more data.
-		if len(w.buf) < w.cfg.minSize && cl == 0 {
-			return len(b), nil
+		if len(w.buf) < minSize {
+			return decisionWait
 		}
-		// If the Content-Length is larger than minSize or the current buffer is larger than minSize, then continue.
-		if cl >= w.cfg.minSize || len(w.buf) >= w.cfg.minSize {
-			// If a Content-Type wasn't specified, infer it from the current buffer.
-			if ct == "" {
-				ct = http.DetectContentType(w.buf)
-				w.Header().Set(contentType, ct)
-			}
-			// If the Content-Type is acceptable to GZIP, initialize the GZIP writer.
-			if handleContentType(w.cfg.contentTypes, ct) {
-				if err := w.startGzip(); err != nil {
-					return 0, err
+	} else if cl < minSize {
+		w.reason = ReasonTooSmall
+		return decisionPlain
+	}
+
+	// If a Content-Type wasn't specified, infer it from the current buffer
+	// and decide again since the content type can change the minSize.
+	if ct == "" {
+		if !sniff {
+			return decisionWait
+		}
+		w.Header().Set(contentType, http.DetectContentType(w.buf))
+		return w.decide(sniff, final)
+	}
+	return decisionGzip
+}
+
+// mediaType returns the parsed Content-Type of the response or nil if it is
+// invalid. The header is only parsed again when it changes, since it is
+// looked at several times per response.
+func (w *gzipResponseWriter) mediaType() *parsedContentType {
+	ct := w.Header().Get(contentType)
+	if w.ctParsed && ct == w.ctHeader {
+		return w.ct
+	}
+	w.ctHeader, w.ctParsed, w.ct = ct, true, nil
+	if mediaType, params, err := parseMediaType(ct); err == nil {
+		w.pct = parsedContentType{mediaType: mediaType, params: params}
+		w.ct = &w.pct
+	}
+	return w.ct
+}
+
+// WriteString writes the string without converting it to a byte slice
+// when the response is passed through as-is.
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var n int
+	var err error
+	if sw, ok := w.ResponseWriter.(io.StringWriter); ok && w.ignore {
+		n, err = sw.WriteString(s)
+		w.bytesIn += int64(n)
+		w.bytesOut += int64(n)
+	} else {
+		n, err = w.write([]byte(s))
+	}
+	if err != nil {
+		w.writeFailed(err)
+	}
+	return n, err
+}
+
+// readFrom feeds the data from src into the response. Once the response is
+// known to be served as-is, src is passed to the underlying ResponseWriter,
+// which enables its sendfile fast path.
+func (w *gzipResponseWriter) readFrom(src io.Reader) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.compress && !w.ignore && len(w.buf) == 0 {
+		if err := w.start(w.decide(false, false)); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int64
+	if !w.compress && !w.ignore {
+		// Feed the regular write path until it decides whether to compress.
+		buf := make([]byte, sniffLen)
+		for !w.compress && !w.ignore {
+			m, err := src.Read(buf)
+			if m > 0 {
+				if _, err := w.write(buf[:m]); err != nil {
+					return n, err
 				}
-				return len(b), nil
+				n += int64(m)
+			}
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
 			}
 		}
 	}
-	// If we got here, we should not GZIP this response.
-	if err := w.startPlain(); err != nil {
-		return 0, err
+
+	var m int64
+	var err error
+	if w.compress {
+		m, err = io.Copy(gzipBodyWriter{w}, src)
+	} else {
+		if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+			m, err = rf.ReadFrom(src)
+		} else {
+			m, err = io.Copy(writerOnly{w.ResponseWriter}, src)
+		}
+		w.bytesIn += m
+		w.bytesOut += m
 	}
-	return len(b), nil
+	return n + m, err
+}
+
+// gzipBodyWriter writes to the gzip writer of the response, which must be
+// locked by the caller.
+type gzipBodyWriter struct {
+	w *gzipResponseWriter
+}
+
+func (b gzipBodyWriter) Write(p []byte) (int, error) {
+	return b.w.writeGzip(p)
+}
+
+// writePlain writes to the underlying ResponseWriter as-is.
+func (w *gzipResponseWriter) writePlain(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytesIn += int64(n)
+	w.bytesOut += int64(n)
+	return n, err
+}
+
+// writerOnly hides optional interfaces of the writer, so io.Copy doesn't
+// call back into ReadFrom.
+type writerOnly struct {
+	io.Writer
+}
+
+// start starts the response according to the decision, if any. The response
+// is still served as-is if the compression level can't be acquired.
+func (w *gzipResponseWriter) start(d decision) error {
+	switch d {
+	case decisionGzip:
+		level, reason := w.cfg.acquireLevel(w.req, w.levelHint(), w.cfg.rule(w.mediaType()))
+		if reason != ReasonNone {
+			w.reason = reason
+			return w.startPlain()
+		}
+		w.level = level
+		return w.startGzip()
+	case decisionPlain:
+		return w.startPlain()
+	}
+	return nil
 }
 
 // startGzip initializes a GZIP writer and writes the buffer.
 func (w *gzipResponseWriter) startGzip() error {
+	w.compress = true
+	w.decided()
+	if w.cfg.stopOnDisconnect && w.req != nil {
+		// Release the gzip writer as soon as the client disconnects rather
+		// than on the next write, which can be a long time coming.
+		w.stopDisconnect = context.AfterFunc(w.req.Context(), w.onDisconnect)
+	}
+	if w.cfg.flushStreamEvents {
+		w.delim = w.cfg.streamDelimiter(w.mediaType())
+	}
+
 	// Set the GZIP header.
 	w.Header().Set(contentEncoding, "gzip")
 
+	// The digest of the content provided by the handler doesn't match the
+	// compressed content.
+	w.Header().Del(contentDigest)
+	for _, alg := range w.cfg.digestAlgs {
+		w.digests = append(w.digests, digestAlgs[alg]())
+	}
+
 	// if the Content-Length is already set, then calls to Write on gzip
 	// will fail to set the Content-Length header since its already set
 	// See: https://github.com/golang/go/issues/14975.
 	w.Header().Del(contentLength)
 
-	// Write the header to gzip response.
-	if w.code != 0 {
-		w.ResponseWriter.WriteHeader(w.code)
-		// Ensure that no other WriteHeader's happen
-		w.code = 0
+	// Write the header to gzip response, unless the whole response is going
+	// to be buffered first.
+	w.buffering = w.cfg.bufferSize > 0
+	if !w.buffering {
+		w.writeHeader()
 	}
 
-	// Initialize and flush the buffer into the gzip response if there are any bytes.
-	// If there aren't any, we shouldn't initialize it yet because on Close it will
-	// write the gzip header even if nothing was ever written.
+	// Flush the buffer into the gzip response if there are any bytes.
+	// If there aren't any, we shouldn't initialize the gzip writer yet because
+	// on Close it will write the gzip header even if nothing was ever written.
 	if len(w.buf) > 0 {
-		// Initialize the GZIP response.
-		w.init()
-		n, err := w.gw.Write(w.buf)
+		n, err := w.writeGzip(w.buf)
 
 		// This should never happen (per io.Writer docs), but if the write didn't
 		// accept the entire buffer but returned no specific error, we have no clue
@@ -126,6 +517,7 @@ func (w *gzipResponseWriter) startGzip() error {
 		if err == nil && n < len(w.buf) {
 			err = io.ErrShortWrite
 		}
+		w.buf = nil
 		return err
 	}
 	return nil
@@ -133,32 +525,90 @@ func (w *gzipResponseWriter) startGzip() error {
 
 // startPlain writes to sent bytes and buffer the underlying ResponseWriter without gzip.
 func (w *gzipResponseWriter) startPlain() error {
-	if w.code != 0 {
-		w.ResponseWriter.WriteHeader(w.code)
-		// Ensure that no other WriteHeader's happen
-		w.code = 0
-	}
 	w.ignore = true
+	w.decided()
+	if w.debug {
+		w.Header().Set(compressionSkipReason, w.reason.String())
+	}
 	// If Write was never called then don't call Write on the underlying ResponseWriter.
 	if w.buf == nil {
+		if w.code != 0 {
+			w.writeHeader()
+		}
 		return nil
 	}
-	n, err := w.ResponseWriter.Write(w.buf)
+	w.writeHeader()
+	buf := w.buf
 	w.buf = nil
+	n, err := w.writePlain(buf)
 	// This should never happen (per io.Writer docs), but if the write didn't
 	// accept the entire buffer but returned no specific error, we have no clue
 	// what's going on, so abort just to be safe.
-	if err == nil && n < len(w.buf) {
+	if err == nil && n < len(buf) {
 		err = io.ErrShortWrite
 	}
 	return err
 }
 
-// WriteHeader just saves the response code until close or GZIP effective writes.
+// writeHeader writes the saved response code to the underlying ResponseWriter.
+// Since the header was held back, the handler may have already set values of
+// the declared trailers, which are hidden so they are only sent as trailers.
+func (w *gzipResponseWriter) writeHeader() {
+	code := w.code
+	// Ensure that no other WriteHeader's happen
+	w.code = 0
+
+	h := w.Header()
+	if len(h[trailer]) == 0 {
+		if code != 0 {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	if code == 0 {
+		code = http.StatusOK
+	}
+
+	var hidden http.Header
+	for _, v := range h[trailer] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vv, ok := h[k]; ok {
+				if hidden == nil {
+					hidden = make(http.Header)
+				}
+				hidden[k] = vv
+				delete(h, k)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+	for k, vv := range hidden {
+		h[k] = vv
+	}
+}
+
+// WriteHeader saves the response code until close or GZIP effective writes,
+// unless the headers are already enough to decide whether to compress.
+// Informational status codes are passed through immediately.
 func (w *gzipResponseWriter) WriteHeader(code int) {
-	if w.code == 0 {
-		w.code = code
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Informational responses such as 103 Early Hints are sent right away
+	// and are followed by the final response.
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if w.code != 0 || w.ignore || w.compress {
+		return
 	}
+	w.code = code
+	w.status = code
+
+	_ = w.start(w.decide(false, false))
 }
 
 // init graps a new gzip writer from the gzipWriterPool and writes the correct
@@ -166,61 +616,448 @@ func (w *gzipResponseWriter) WriteHeader(code int) {
 func (w *gzipResponseWriter) init() {
 	// Bytes written during ServeHTTP are redirected to this gzip writer
 	// before being written to the underlying response.
-	gw := w.cfg.pool.Get().(*gzip.Writer)
-	gw.Reset(w.ResponseWriter)
+	gw := w.cfg.getWriter(w.level)
+	if w.cfg.asyncSize > 0 {
+		w.async = newAsyncWriter(w, gw)
+	} else {
+		gw.Reset(gzipOutput{w})
+	}
+	if w.cfg.padding > 0 {
+		gw.Header.Extra = padding[:paddingLen(w.cfg.padding)]
+	}
+	if w.level == gzip.StatelessCompression || w.level == gzip.HuffmanOnly {
+		w.block = make([]byte, 0, minBlockSize)
+	}
 	w.gw = gw
 }
 
+// gzipOutput receives the compressed bytes from the gzip writer.
+type gzipOutput struct {
+	w *gzipResponseWriter
+}
+
+func (o gzipOutput) Write(b []byte) (int, error) {
+	w := o.w
+	for _, h := range w.digests {
+		h.Write(b)
+	}
+	w.bytesOut += int64(len(b))
+
+	if w.buffering {
+		if len(w.out)+len(b) <= w.cfg.bufferSize {
+			w.out = append(w.out, b...)
+			return len(b), nil
+		}
+		if err := w.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Writing to the client doesn't count as compressing.
+	start := w.startTimer()
+	n, err := w.ResponseWriter.Write(b)
+	if w.cfg.measure {
+		w.dur -= time.Since(start)
+	}
+	return n, err
+}
+
+// spill stops buffering and writes out the header and the buffered part of
+// the compressed response.
+func (w *gzipResponseWriter) spill() error {
+	w.buffering = false
+	w.writeHeader()
+
+	out := w.out
+	w.out = nil
+	if len(out) == 0 {
+		return nil
+	}
+	n, err := w.ResponseWriter.Write(out)
+	if err == nil && n < len(out) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// setDigest sets the Content-Digest of the compressed response, which is
+// only known in advance of the body when the whole response was buffered.
+func (w *gzipResponseWriter) setDigest() {
+	var b strings.Builder
+	for i, h := range w.digests {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(w.cfg.digestAlgs[i])
+		b.WriteString("=:")
+		b.WriteString(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		b.WriteString(":")
+	}
+
+	key := contentDigest
+	if !w.buffering {
+		key = http.TrailerPrefix + key
+	}
+	w.Header().Set(key, b.String())
+}
+
 // Close will close the gzip.Writer and will put it back in the gzipWriterPool.
 func (w *gzipResponseWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
+func (w *gzipResponseWriter) close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.unwatchDisconnect()
+	defer w.endSpan()
+	defer w.completed()
+
+	if w.compress {
+		if w.disconnected() {
+			// There is no one to receive the gzip footer.
+			return nil
+		}
+		return w.closeGzip()
+	}
 	if w.ignore {
 		return nil
 	}
 
-	if w.gw == nil {
-		// GZIP not triggered yet, write out regular response.
-		err := w.startPlain()
-		// Returns the error if any at write.
-		if err != nil {
-			err = fmt.Errorf("gziphandler: write to regular responseWriter at close gets error: %q", err.Error())
+	// GZIP not triggered yet, so the whole body is buffered.
+	err := w.start(w.decide(true, true))
+	if w.compress {
+		if cerr := w.closeGzip(); err == nil {
+			err = cerr
 		}
 		return err
 	}
 
-	err := w.gw.Close()
-	w.cfg.pool.Put(w.gw)
-	w.gw = nil
+	// Otherwise the regular response has been written out.
+	// Returns the error if any at write.
+	if err != nil {
+		err = fmt.Errorf("gziphandler: write to regular responseWriter at close gets error: %q", err.Error())
+	}
 	return err
 }
 
+// closeGzip finishes the compressed response.
+func (w *gzipResponseWriter) closeGzip() error {
+	defer w.cfg.releaseLevel()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.pending = false
+	}
+
+	// A stream can end without any events, and still needs a valid gzip
+	// stream. Other empty bodies, e.g. for HEAD requests, stay empty.
+	if w.gw == nil && w.cfg.streamDelimiter(w.mediaType()) != nil {
+		w.init()
+	}
+
+	var err error
+	if w.gw != nil {
+		if w.cfg.uncompressedTrailers {
+			w.Header().Set(http.TrailerPrefix+uncompressedLength, strconv.FormatInt(w.bytesIn, 10))
+			w.Header().Set(http.TrailerPrefix+uncompressedCRC32, fmt.Sprintf("%08x", w.crc))
+		}
+
+		start := w.startTimer()
+		err = w.writeOutBlock()
+		if w.async != nil {
+			if cerr := w.async.Close(); err == nil {
+				err = cerr
+			}
+			w.async = nil
+		} else {
+			if w.par != nil {
+				if cerr := w.par.Close(); err == nil {
+					err = cerr
+				}
+				w.par = nil
+			}
+			if err == nil {
+				err = w.gw.Close()
+			}
+		}
+		w.stopTimer(start)
+		w.cfg.putWriter(w.gw, w.level)
+		w.gw = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if w.digests != nil {
+		w.setDigest()
+	}
+	w.setDebugHeaders()
+	if w.buffering {
+		// The whole response fits into the buffer. net/http doesn't send
+		// trailers with a Content-Length, so they are sent as headers.
+		w.trailersToHeader()
+		w.Header().Set(contentLength, strconv.Itoa(len(w.out)))
+		return w.spill()
+	}
+	return nil
+}
+
+// trailersToHeader turns the declared and the http.TrailerPrefix trailers
+// into headers, since the whole response is known before the header is
+// written.
+func (w *gzipResponseWriter) trailersToHeader() {
+	h := w.Header()
+	delete(h, trailer)
+	for k, vv := range h {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok {
+			delete(h, k)
+			h[http.CanonicalHeaderKey(name)] = vv
+		}
+	}
+}
+
+// abort closes the writer without writing anything more to the underlying
+// ResponseWriter. The gzip writer is discarded rather than put back into the
+// pool because it can be in the middle of a write.
+func (w *gzipResponseWriter) abort() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.unwatchDisconnect()
+	defer w.endSpan()
+	w.discard(false)
+}
+
+// disconnected reports whether the client of a compressed response has
+// disconnected, in which case the rest of the response is discarded.
+func (w *gzipResponseWriter) disconnected() bool {
+	if w.discarded {
+		return true
+	}
+	if !w.cfg.stopOnDisconnect || w.req == nil || w.req.Context().Err() == nil {
+		return false
+	}
+	w.discard(true)
+	return true
+}
+
+// onDisconnect discards the response when the request is done.
+func (w *gzipResponseWriter) onDisconnect() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed {
+		w.disconnected()
+	}
+}
+
+// unwatchDisconnect stops onDisconnect from being called.
+func (w *gzipResponseWriter) unwatchDisconnect() {
+	if w.stopDisconnect != nil && w.stopDisconnect() {
+		w.stopDisconnect = nil
+	}
+}
+
+// discard drops the rest of the compressed response and releases its
+// compression level. The gzip writer is put back into the pool if reuse is
+// true.
+func (w *gzipResponseWriter) discard(reuse bool) {
+	if w.discarded {
+		return
+	}
+	w.discarded = true
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.pending = false
+	}
+	if w.async != nil {
+		w.async.stop()
+		w.async = nil
+	}
+	if w.gw != nil && reuse {
+		w.cfg.putWriter(w.gw, w.level)
+	}
+	w.gw = nil
+	w.par = nil
+	w.buf = nil
+	w.block = nil
+	w.out = nil
+	if w.compress {
+		w.cfg.releaseLevel()
+	}
+}
+
+// startTimer returns the current time if the compression time is measured.
+func (w *gzipResponseWriter) startTimer() time.Time {
+	if !w.cfg.measure {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// stopTimer adds the time since start to the compression time.
+func (w *gzipResponseWriter) stopTimer(start time.Time) {
+	if w.cfg.measure {
+		w.dur += time.Since(start)
+	}
+}
+
 // Flush flushes the underlying *gzip.Writer and then the underlying
 // http.ResponseWriter if it is an http.Flusher. This makes gzipResponseWriter
 // an http.Flusher.
 func (w *gzipResponseWriter) Flush() {
-	if w.gw == nil && !w.ignore {
+	if err := w.FlushError(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		w.cfg.failed(w.req, "flush", err)
+	}
+}
+
+// FlushError is like Flush but returns the error, if any. It is used by
+// http.ResponseController.
+func (w *gzipResponseWriter) FlushError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.compress && !w.ignore {
+		// The headers alone may be enough to decide, e.g. for a stream
+		// that is flushed before its first event.
+		if err := w.start(w.decide(false, false)); err != nil {
+			return err
+		}
+	}
+	if !w.compress && !w.ignore {
 		// Only flush once startGzip or startPlain has been called.
 		//
 		// Flush is thus a no-op until we're certain whether a plain
 		// or gzipped response will be served.
-		return
+		return nil
+	}
+
+	return w.flush()
+}
+
+func (w *gzipResponseWriter) flush() error {
+	w.pending = false
+
+	// Send the gzip header of a compressed response that has nothing
+	// written to it yet, so the client knows the stream is alive.
+	if w.compress && w.gw == nil && !w.discarded {
+		w.init()
 	}
 
 	if w.gw != nil {
-		w.gw.Flush()
+		start := w.startTimer()
+		err := w.writeOutBlock()
+		if err == nil && w.async != nil {
+			err = w.async.Flush()
+		} else if err == nil {
+			if w.par != nil {
+				err = w.par.Flush()
+			}
+			if err == nil {
+				err = w.gw.Flush()
+			}
+		}
+		w.stopTimer(start)
+		if err != nil {
+			return err
+		}
 	}
+	if w.buffering {
+		if err := w.spill(); err != nil {
+			return err
+		}
+	}
+
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// flushQuietly flushes on behalf of the handler, which didn't ask for it, so
+// it doesn't mind the underlying ResponseWriter being unable to flush.
+func (w *gzipResponseWriter) flushQuietly() error {
+	if err := w.flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// scheduleFlush arranges for the written data to be flushed unless more
+// writes arrive within the configured flush latency.
+func (w *gzipResponseWriter) scheduleFlush() {
+	// A buffered response is held back on purpose and flushing it would
+	// write the header, which the handler may still be changing, from the
+	// timer goroutine.
+	if w.buffering {
+		return
+	}
+	w.pending = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.cfg.flushLatency, w.idleFlush)
+	} else {
+		w.timer.Reset(w.cfg.flushLatency)
+	}
+}
+
+// idleFlush is called by the flush timer, concurrently with the handler.
+func (w *gzipResponseWriter) idleFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The data could have been flushed or the writer closed meanwhile.
+	if w.pending && w.gw != nil && !w.buffering {
+		if err := w.flushQuietly(); err != nil {
+			w.cfg.failed(w.req, "flush", err)
+		}
+	}
+}
 
-	if fw, ok := w.ResponseWriter.(http.Flusher); ok {
-		fw.Flush()
+// endsEvent reports whether b completes an event of a streaming response.
+// An event of text/event-stream ends with a blank line, and its lines can end
+// with "\n", "\r\n" or "\r".
+func (w *gzipResponseWriter) endsEvent(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	prev := w.last
+	w.last = b[len(b)-1]
+	if len(w.delim) == 1 {
+		return bytes.Contains(b, w.delim)
+	}
+	if prev != 0 && isBlankLine(prev, b[0]) {
+		return true
 	}
+	for _, delim := range eventDelimiters {
+		if bytes.Contains(b, delim) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlankLine reports whether the bytes end a line and then a blank line.
+func isBlankLine(a, b byte) bool {
+	return (a == '\n' && (b == '\n' || b == '\r')) || (a == '\r' && b == '\r')
 }
 
 // Hijack implements http.Hijacker. If the underlying ResponseWriter is a
 // Hijacker, its Hijack method is returned. Otherwise an error is returned.
 func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
-		return hj.Hijack()
-	}
-	return nil, nil, fmt.Errorf("http.Hijacker interface is not supported")
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter, which allows
+// http.ResponseController to reach its optional methods.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 // verify Hijacker interface implementation
@@ -235,7 +1072,7 @@ type parsedContentType struct {
 
 // equals returns whether this content type matches another content type.
 func (pct parsedContentType) equals(mediaType string, params map[string]string) bool {
-	if pct.mediaType != mediaType {
+	if !matchMediaType(pct.mediaType, mediaType) {
 		return false
 	}
 	// if pct has no params, don't care about other's params
@@ -254,3 +1091,20 @@ func (pct parsedContentType) equals(mediaType string, params map[string]string)
 	}
 	return true
 }
+
+// matchMediaType matches the media type against the pattern, which can have
+// a wildcard subtype or be a wildcard altogether.
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == mediaType || pattern == "*/*" {
+		return true
+	}
+	typ, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(mediaType, typ) && strings.HasPrefix(mediaType[len(typ):], "/")
+}
+
+// contentTypeRule is the parsed ContentTypeRule.
+type contentTypeRule struct {
+	parsedContentType
+	level   int
+	minSize int
+}
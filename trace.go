@@ -0,0 +1,59 @@
+package httpgzip
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer starts spans, e.g. by adapting an OpenTelemetry tracer, so
+// that the compression of responses appears in traces.
+type Tracer interface {
+	// Start starts a span that is a child of the span in ctx, if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute with a string, int or int64 value.
+	SetAttribute(key string, value any)
+	// End ends the span.
+	End()
+}
+
+// Attributes of the spans.
+const (
+	AttrCoding     = "httpgzip.coding"
+	AttrLevel      = "httpgzip.level"
+	AttrBytesIn    = "httpgzip.bytes_in"
+	AttrBytesOut   = "httpgzip.bytes_out"
+	AttrSkipReason = "httpgzip.skip_reason"
+)
+
+const spanName = "httpgzip.response"
+
+// startSpan starts the span of the response if the request is known.
+func (c *Config) startSpan(r *http.Request) Span {
+	if c.tracer == nil || r == nil {
+		return nil
+	}
+	_, span := c.tracer.Start(r.Context(), spanName)
+	return span
+}
+
+// endSpan annotates the span of the response with the result and ends it.
+func (w *gzipResponseWriter) endSpan() {
+	if w.span == nil {
+		return
+	}
+	if w.compress {
+		w.span.SetAttribute(AttrCoding, "gzip")
+		w.span.SetAttribute(AttrLevel, w.level)
+	} else {
+		w.span.SetAttribute(AttrCoding, "identity")
+		w.span.SetAttribute(AttrSkipReason, w.reason.String())
+	}
+	w.span.SetAttribute(AttrBytesIn, w.bytesIn)
+	w.span.SetAttribute(AttrBytesOut, w.bytesOut)
+	w.span.End()
+	w.span = nil
+}
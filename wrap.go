@@ -0,0 +1,134 @@
+package httpgzip
+
+import (
+	"io"
+	"net/http"
+)
+
+// Optional interfaces of the underlying ResponseWriter that gzipResponseWriter
+// only implements when the underlying ResponseWriter does.
+const (
+	closeNotifier = 1 << iota
+	readerFrom
+	pusher
+)
+
+// wrap returns the writer as a type that implements the same optional
+// interfaces as the underlying ResponseWriter.
+func (w *gzipResponseWriter) wrap() ResponseWriter {
+	var flags int
+	if _, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		flags |= closeNotifier
+	}
+	if _, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		flags |= readerFrom
+	}
+	if _, ok := w.ResponseWriter.(http.Pusher); ok {
+		flags |= pusher
+	}
+
+	switch flags {
+	case closeNotifier:
+		return gzipResponseWriterWithCloseNotify{w}
+	case readerFrom:
+		return gzipResponseWriterWithReadFrom{w}
+	case pusher:
+		return gzipResponseWriterWithPush{w}
+	case closeNotifier | readerFrom:
+		return gzipResponseWriterWithCloseNotifyReadFrom{w}
+	case closeNotifier | pusher:
+		return gzipResponseWriterWithCloseNotifyPush{w}
+	case readerFrom | pusher:
+		return gzipResponseWriterWithReadFromPush{w}
+	case closeNotifier | readerFrom | pusher:
+		return gzipResponseWriterWithCloseNotifyReadFromPush{w}
+	}
+	return w
+}
+
+func (w *gzipResponseWriter) closeNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *gzipResponseWriter) push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// gzipResponseWriterWithCloseNotify is only there for compatibility with
+// handlers using the deprecated http.CloseNotifier. New code should use
+// Request.Context instead.
+type gzipResponseWriterWithCloseNotify struct {
+	*gzipResponseWriter
+}
+
+func (w gzipResponseWriterWithCloseNotify) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+type gzipResponseWriterWithReadFrom struct {
+	*gzipResponseWriter
+}
+
+func (w gzipResponseWriterWithReadFrom) ReadFrom(src io.Reader) (int64, error) {
+	return w.readFrom(src)
+}
+
+type gzipResponseWriterWithPush struct {
+	*gzipResponseWriter
+}
+
+func (w gzipResponseWriterWithPush) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+type gzipResponseWriterWithCloseNotifyReadFrom struct {
+	*gzipResponseWriter
+}
+
+func (w gzipResponseWriterWithCloseNotifyReadFrom) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+func (w gzipResponseWriterWithCloseNotifyReadFrom) ReadFrom(src io.Reader) (int64, error) {
+	return w.readFrom(src)
+}
+
+type gzipResponseWriterWithCloseNotifyPush struct {
+	*gzipResponseWriter
+}
+
+func (w gzipResponseWriterWithCloseNotifyPush) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+func (w gzipResponseWriterWithCloseNotifyPush) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+type gzipResponseWriterWithReadFromPush struct {
+	*gzipResponseWriter
+}
+
+func (w gzipResponseWriterWithReadFromPush) ReadFrom(src io.Reader) (int64, error) {
+	return w.readFrom(src)
+}
+
+func (w gzipResponseWriterWithReadFromPush) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+type gzipResponseWriterWithCloseNotifyReadFromPush struct {
+	*gzipResponseWriter
+}
+
+func (w gzipResponseWriterWithCloseNotifyReadFromPush) CloseNotify() <-chan bool {
+	return w.closeNotify()
+}
+
+func (w gzipResponseWriterWithCloseNotifyReadFromPush) ReadFrom(src io.Reader) (int64, error) {
+	return w.readFrom(src)
+}
+
+func (w gzipResponseWriterWithCloseNotifyReadFromPush) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}